@@ -0,0 +1,99 @@
+package firebasehelpers
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ConnectionStatus tells whether stream is connected to firebase
+type ConnectionStatus int
+
+const (
+	// Disconnected means the stream isn't watching firebase
+	Disconnected ConnectionStatus = iota
+	// Connecting means the stream is establishing connection to firebase
+	Connecting
+	// Connected means the stream is receiving events from firebase
+	Connected
+	// Reconnecting means connection has failed and the stream waits to retry
+	Reconnecting
+)
+
+func (s ConnectionStatus) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	}
+
+	return "unknown"
+}
+
+// ConnectionState describes connection of stream to firebase. It's also
+// available to listeners at synthetic path ".info", as boolean at
+// ".info/connected" and object at ".info/connection".
+type ConnectionState struct {
+	Status ConnectionStatus
+	// Attempt is number of failed attempts since the last successful connection
+	Attempt int
+	// NextRetry is time of the next attempt, set only when reconnecting
+	NextRetry time.Time
+	// LastError is the error that caused the last failed attempt
+	LastError error
+}
+
+func (s ConnectionState) json() []byte {
+	type connection struct {
+		Status    string     `json:"status"`
+		Attempt   int        `json:"attempt"`
+		NextRetry *time.Time `json:"nextRetry,omitempty"`
+		LastError string     `json:"lastError,omitempty"`
+	}
+
+	c := connection{Status: s.Status.String(), Attempt: s.Attempt}
+
+	if !s.NextRetry.IsZero() {
+		c.NextRetry = &s.NextRetry
+	}
+
+	if s.LastError != nil {
+		c.LastError = s.LastError.Error()
+	}
+
+	result, err := json.Marshal(map[string]interface{}{
+		".info": map[string]interface{}{
+			"connected":  s.Status == Connected,
+			"connection": c,
+		},
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return result
+}
+
+// ConnectionState returns current state of connection to firebase
+func (w *Stream) ConnectionState() ConnectionState {
+	w.connectionMux.Lock()
+	defer w.connectionMux.Unlock()
+
+	return w.connection
+}
+
+func (w *Stream) setConnectionState(update func(*ConnectionState)) {
+	w.connectionMux.Lock()
+	defer w.connectionMux.Unlock()
+
+	update(&w.connection)
+
+	if w.info != nil {
+		w.info.Push(w.connection.json())
+	}
+}
@@ -0,0 +1,84 @@
+package firebasehelpers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionStateJSON(t *testing.T) {
+	state := ConnectionState{
+		Status:    Reconnecting,
+		Attempt:   2,
+		NextRetry: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		LastError: errors.New("boom"),
+	}
+
+	expected := `{".info":{"connected":false,"connection":{"status":"reconnecting","attempt":2,"nextRetry":"2020-01-02T03:04:05Z","lastError":"boom"}}}`
+
+	assert.Equal(t, expected, string(state.json()))
+	assert.Equal(t, `{".info":{"connected":true,"connection":{"status":"connected","attempt":0}}}`, string(ConnectionState{Status: Connected}.json()))
+}
+
+func TestConnectionStateListen(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+	defer stream.Shutdown()
+
+	assert.Equal(t, Disconnected, stream.ConnectionState().Status)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	snapshot, err := stream.Select(".info", "connected").Once(ctx)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`false`), snapshot.Raw())
+
+	events := stream.Select(".info").Watch(ctx, []string{"connected"}, WatchOptions{})
+
+	// The root listener for data must not see the synthetic tree
+	stream.Listen([]string{"*"}, func(path []string, prev []byte, curr []byte) {
+		t.Errorf("unexpected change at %v", path)
+	})
+
+	statuses := make(chan string, 10)
+
+	stream.Listen([]string{".info", "connection", "status"}, func(path []string, prev []byte, curr []byte) {
+		statuses <- string(curr)
+	})
+
+	assert.Equal(t, `"disconnected"`, <-statuses)
+
+	stream.setConnectionState(func(s *ConnectionState) {
+		s.Status = Connected
+	})
+
+	assert.Equal(t, `"connected"`, <-statuses)
+
+	event := <-events
+
+	assert.Equal(t, Added, event.Kind)
+	assert.Equal(t, []byte(`false`), event.Curr)
+
+	event = <-events
+
+	assert.Equal(t, Changed, event.Kind)
+	assert.Equal(t, []string{".info", "connected"}, event.Path)
+	assert.Equal(t, []byte(`true`), event.Curr)
+
+	snapshot, err = stream.Select(".info", "connection").WaitFor(ctx, func(s Snapshot) bool {
+		var status string
+		s.Child("status").Decode(&status)
+		return status == "connected"
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, Connected, stream.ConnectionState().Status)
+}
@@ -0,0 +1,303 @@
+package firebasehelpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Stream keeps its value decoded and changes it in place, so applying a put or
+// patch costs as much as the changed part of the tree, not the whole of it.
+
+// Decodes json keeping numbers as they are written
+func decodeTree(value []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var tree interface{}
+
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// Encodes decoded tree, or returns nil if it's missing
+func encodeTree(tree interface{}) []byte {
+	if tree == nil {
+		return nil
+	}
+
+	buffer := new(bytes.Buffer)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(tree); err != nil {
+		return nil
+	}
+
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n"))
+}
+
+// Change of decoded tree sent by firebase. Children not matching query are
+// removed after the change is applied.
+type treeOp struct {
+	patch bool
+	path  []string
+	data  interface{}
+	query *Query
+}
+
+// Applies op to tree and returns new tree along with paths of removed children
+func (op treeOp) apply(tree interface{}, undo *undoLog) (interface{}, [][]string) {
+	if op.patch {
+		if data, ok := op.data.(map[string]interface{}); ok {
+			tree = patch(tree, op.path, data, undo)
+		}
+	} else {
+		tree = put(tree, op.path, op.data, undo)
+	}
+
+	if op.query == nil {
+		return tree, nil
+	}
+
+	return op.query.prune(tree, undo)
+}
+
+// Values replaced in objects of decoded tree while applying an update, so
+// the previous tree can be read without copying it. Objects are identified by
+// address, and kept referenced so the address isn't reused meanwhile.
+type undoLog struct {
+	objects map[uintptr]*undoEntry
+}
+
+type undoEntry struct {
+	object map[string]interface{}
+	values map[string]interface{}
+}
+
+func newUndoLog() *undoLog {
+	return &undoLog{objects: map[uintptr]*undoEntry{}}
+}
+
+// Remembers value of key before it's changed for the first time, nil means
+// the key was missing
+func (l *undoLog) record(object map[string]interface{}, key string) {
+	if l == nil {
+		return
+	}
+
+	id := reflect.ValueOf(object).Pointer()
+	entry := l.objects[id]
+
+	if entry == nil {
+		entry = &undoEntry{object: object, values: map[string]interface{}{}}
+		l.objects[id] = entry
+	}
+
+	if _, ok := entry.values[key]; !ok {
+		entry.values[key] = object[key]
+	}
+}
+
+// Returns values replaced in object, or nil if it hasn't changed
+func (l *undoLog) replaced(object map[string]interface{}) map[string]interface{} {
+	if l == nil {
+		return nil
+	}
+
+	if entry := l.objects[reflect.ValueOf(object).Pointer()]; entry != nil {
+		return entry.values
+	}
+
+	return nil
+}
+
+// Json tree matched against patterns of listeners
+type node interface {
+	// Returns direct child of object or array, or nil if it's missing
+	child(key string) node
+	// Calls fn for each child of object or array in key order
+	eachChild(fn func(key string, child node))
+	// Returns json of the node
+	json() []byte
+}
+
+// Returns json of node, or nil if it's missing
+func nodeJSON(n node) []byte {
+	if n == nil {
+		return nil
+	}
+
+	return n.json()
+}
+
+// Returns node at path, or nil if it's missing
+func getNode(n node, path ...string) node {
+	for _, key := range path {
+		if n == nil {
+			return nil
+		}
+
+		n = n.child(key)
+	}
+
+	return n
+}
+
+// Node of decoded tree. With undo log it's a node of the tree from before the
+// logged changes.
+type treeNode struct {
+	value interface{}
+	undo  *undoLog
+}
+
+func (n treeNode) node(value interface{}) node {
+	if value == nil {
+		return nil
+	}
+
+	return treeNode{value: value, undo: n.undo}
+}
+
+func (n treeNode) child(key string) node {
+	switch typed := n.value.(type) {
+	case map[string]interface{}:
+		if value, ok := n.undo.replaced(typed)[key]; ok {
+			return n.node(value)
+		}
+
+		return n.node(typed[key])
+	case []interface{}:
+		index, err := strconv.Atoi(key)
+
+		if err != nil || index < 0 || index >= len(typed) || strconv.Itoa(index) != key {
+			return nil
+		}
+
+		return n.node(typed[index])
+	}
+
+	return nil
+}
+
+// Children of objects are visited in key order, as objects aren't ordered
+func (n treeNode) eachChild(fn func(key string, child node)) {
+	switch typed := n.value.(type) {
+	case map[string]interface{}:
+		replaced := n.undo.replaced(typed)
+		keys := make([]string, 0, len(typed)+len(replaced))
+
+		for key := range typed {
+			keys = append(keys, key)
+		}
+
+		for key := range replaced {
+			if _, ok := typed[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			return compareKeys(keys[i], keys[j]) < 0
+		})
+
+		for _, key := range keys {
+			if child := n.child(key); child != nil {
+				fn(key, child)
+			}
+		}
+	case []interface{}:
+		for i, item := range typed {
+			if item != nil {
+				fn(strconv.Itoa(i), n.node(item))
+			}
+		}
+	}
+}
+
+func (n treeNode) json() []byte {
+	return encodeTree(n.restore(n.value))
+}
+
+// Returns copy of value with replaced values put back, or value itself if
+// there is no undo log
+func (n treeNode) restore(value interface{}) interface{} {
+	if n.undo == nil {
+		return value
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		result := map[string]interface{}{}
+
+		treeNode{value: typed, undo: n.undo}.eachChild(func(key string, child node) {
+			result[key] = n.restore(child.(treeNode).value)
+		})
+
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(typed))
+
+		for i, item := range typed {
+			result[i] = n.restore(item)
+		}
+
+		return result
+	}
+
+	return value
+}
+
+// Compares keys the way firebase orders them, keys that are 32-bit integers go
+// before other keys and are sorted numerically
+func compareKeys(a string, b string) int {
+	aInt, aErr := strconv.ParseInt(a, 10, 32)
+	bInt, bErr := strconv.ParseInt(b, 10, 32)
+
+	aIsInt := aErr == nil && strconv.FormatInt(aInt, 10) == a
+	bIsInt := bErr == nil && strconv.FormatInt(bInt, 10) == b
+
+	switch {
+	case aIsInt && bIsInt:
+		if aInt < bInt {
+			return -1
+		} else if aInt > bInt {
+			return 1
+		}
+
+		return 0
+	case aIsInt:
+		return -1
+	case bIsInt:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
+
+// Sorts paths key by key in the order of compareKeys, parents go before their
+// children. Paths matched without "**" are sorted already, so they're only
+// checked.
+func sortPaths(paths [][]string) {
+	less := func(i, j int) bool {
+		a, b := paths[i], paths[j]
+
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if c := compareKeys(a[k], b[k]); c != 0 {
+				return c < 0
+			}
+		}
+
+		return len(a) < len(b)
+	}
+
+	if !sort.SliceIsSorted(paths, less) {
+		sort.SliceStable(paths, less)
+	}
+}
@@ -0,0 +1,182 @@
+package firebasehelpers
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns node of decoded json for matching tests
+func decoded(json []byte) node {
+	tree, err := decodeTree(json)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return treeNode{value: tree}
+}
+
+func TestUndoLog(t *testing.T) {
+	tree, err := decodeTree([]byte(`{"a":{"b":1,"c":[1,2]},"d":true,"e":{"f":1}}`))
+
+	assert.NoError(t, err)
+
+	undo := newUndoLog()
+	previous := treeNode{value: tree, undo: undo}
+
+	ops := []treeOp{
+		{path: []string{"a", "b"}, data: "x"},
+		{patch: true, path: []string{"a"}, data: map[string]interface{}{"g": 3.0}},
+		{path: []string{"d"}},
+		{path: []string{"e", "f"}},
+	}
+
+	for _, op := range ops {
+		tree, _ = op.apply(tree, undo)
+	}
+
+	assert.Equal(t, `{"a":{"b":1,"c":[1,2]},"d":true,"e":{"f":1}}`, string(previous.json()))
+	assert.Equal(t, `{"a":{"b":"x","c":[1,2],"g":3}}`, string(treeNode{value: tree}.json()))
+
+	assert.Equal(t, []byte(`1`), nodeJSON(getNode(previous, "a", "b")))
+	assert.Nil(t, getNode(previous, "a", "g"))
+	assert.Equal(t, []byte(`{"f":1}`), nodeJSON(getNode(previous, "e")))
+	assert.Equal(t, [][]string{{"a", "b"}, {"a", "c"}}, matches(previous, []string{"a", "*"}))
+}
+
+func TestSortPaths(t *testing.T) {
+	paths := [][]string{{"b"}, {"a", "x"}, {"10"}, {"a"}, {"9", "y"}, {"-1"}}
+
+	sortPaths(paths)
+
+	assert.Equal(t, [][]string{{"-1"}, {"9", "y"}, {"10"}, {"a"}, {"a", "x"}, {"b"}}, paths)
+}
+
+func TestStreamOps(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	events := make(chan Event, 10)
+
+	stream.Listen([]string{"*"}, func(path []string, prev []byte, curr []byte) {
+		events <- Event{Path: path, Prev: prev, Curr: curr}
+	})
+
+	players, _ := decodeTree([]byte(`{"foo":{"score":1},"bar":{"score":2}}`))
+
+	stream.push(update{ops: []treeOp{{data: players}}})
+
+	// Children are visited in key order, not in order of the document
+	assert.Equal(t, Event{Path: []string{"bar"}, Curr: []byte(`{"score":2}`)}, <-events)
+	assert.Equal(t, Event{Path: []string{"foo"}, Curr: []byte(`{"score":1}`)}, <-events)
+
+	patch := treeOp{patch: true, path: []string{"foo"}, data: map[string]interface{}{"score": 4.0}}
+	remove := treeOp{path: []string{"bar"}}
+
+	stream.push(update{ops: []treeOp{patch, remove}, paths: [][]string{{"foo", "score"}, {"bar"}}})
+
+	assert.Equal(t, Event{Path: []string{"bar"}, Prev: []byte(`{"score":2}`)}, <-events)
+	assert.Equal(t, Event{Path: []string{"foo"}, Prev: []byte(`{"score":1}`), Curr: []byte(`{"score":4}`)}, <-events)
+
+	assert.Equal(t, []byte(`{"foo":{"score":4}}`), stream.Select().Value())
+
+	stream.Close()
+}
+
+func TestStreamOpsQuery(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	events := make(chan Event, 10)
+
+	stream.ListenEvents([]string{"$player"}, func(event Event) {
+		events <- event
+	})
+
+	query := NewQuery(OrderByChild("score")).LimitToLast(2)
+	players, _ := decodeTree([]byte(`{"foo":{"score":1},"bar":{"score":2},"baz":{"score":3}}`))
+
+	stream.push(update{ops: []treeOp{{data: players, query: query}}})
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"bar"}, Curr: []byte(`{"score":2}`), Bindings: map[string]string{"player": "bar"}, Revision: 1}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"baz"}, Curr: []byte(`{"score":3}`), Bindings: map[string]string{"player": "baz"}, Revision: 1}, <-events)
+
+	// Patch moves foo into the query and pushes bar out of it
+	patch := treeOp{patch: true, path: []string{"foo"}, data: map[string]interface{}{"score": 4.0}, query: query}
+	stream.push(update{ops: []treeOp{patch}, paths: [][]string{{"foo", "score"}}})
+
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"bar"}, Prev: []byte(`{"score":2}`), Bindings: map[string]string{"player": "bar"}, Revision: 2}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"foo"}, Curr: []byte(`{"score":4}`), Bindings: map[string]string{"player": "foo"}, Revision: 2}, <-events)
+
+	assert.Equal(t, []byte(`{"baz":{"score":3},"foo":{"score":4}}`), stream.Select().Value())
+
+	stream.Close()
+}
+
+// Returns stream with n managers and listener of each of them, along with
+// update changing one of them
+func newPatchedStream(n int) (*Stream, update) {
+	stream := NewStreamContext(context.Background(), StreamOptions{})
+
+	managers := map[string]interface{}{}
+
+	for i := 0; i < n; i++ {
+		managers[strconv.Itoa(i)] = map[string]interface{}{"name": "Manager"}
+	}
+
+	stream.push(update{ops: []treeOp{{path: []string{"managers"}, data: managers}}})
+
+	done := make(chan struct{})
+	last := strconv.Itoa(n - 1)
+
+	// Managers are added in key order
+	stream.Listen([]string{"managers", "*", "name"}, func(path []string, prev []byte, curr []byte) {
+		if prev == nil && curr != nil && path[1] == last {
+			close(done)
+		}
+	})
+
+	<-done
+
+	patch := treeOp{patch: true, path: []string{"managers", "1"}, data: map[string]interface{}{"name": "Changed"}}
+
+	return stream, update{ops: []treeOp{patch}, paths: [][]string{{"managers", "1", "name"}}}
+}
+
+func TestPatchCostDoesNotDependOnTreeSize(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	allocs := func(n int) float64 {
+		stream, u := newPatchedStream(n)
+		defer stream.Close()
+
+		return testing.AllocsPerRun(100, func() {
+			stream.processSingle(u)
+		})
+	}
+
+	// Background goroutines of the stream can allocate now and then
+	assert.InDelta(t, allocs(10), allocs(10000), 2)
+}
+
+func BenchmarkPatch(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			stream, u := newPatchedStream(n)
+			defer stream.Close()
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				stream.processSingle(u)
+			}
+
+			b.StopTimer()
+		})
+	}
+}
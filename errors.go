@@ -0,0 +1,122 @@
+package firebasehelpers
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorKind tells what kind of failure an error describes
+type ErrorKind int
+
+const (
+	// TransientError means a failure that goes away by itself, like dropped
+	// connection or missed keep-alive. Errors that aren't classified are
+	// considered transient.
+	TransientError ErrorKind = iota
+	// AuthError means firebase revoked credentials used by the stream
+	AuthError
+	// PermissionError means firebase cancelled the stream, usually because
+	// security rules don't allow to read watched location
+	PermissionError
+	// ProtocolError means firebase sent something the stream can't handle
+	ProtocolError
+	// DecodeError means a value could not be parsed or decoded
+	DecodeError
+	// PanicError means a listener callback has panicked
+	PanicError
+	// OverflowError means a listener dropped an event, as it couldn't keep up
+	OverflowError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case TransientError:
+		return "transient"
+	case AuthError:
+		return "auth"
+	case PermissionError:
+		return "permission"
+	case ProtocolError:
+		return "protocol"
+	case DecodeError:
+		return "decode"
+	case PanicError:
+		return "panic"
+	case OverflowError:
+		return "overflow"
+	}
+
+	return "unknown"
+}
+
+// Error is error reported by stream along with its kind
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error for errors.Cause
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error for errors.Is and errors.As
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(kind ErrorKind, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func errorf(kind ErrorKind, format string, args ...interface{}) *Error {
+	return newError(kind, errors.New(fmt.Sprintf(format, args...)))
+}
+
+// KindOf returns kind of err or any error it wraps, and TransientError if
+// it's not classified
+func KindOf(err error) ErrorKind {
+	var e *Error
+
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	return TransientError
+}
+
+// ErrorAction tells how to handle error that ended connection to firebase
+type ErrorAction int
+
+const (
+	// Retry connects again after backoff delay
+	Retry ErrorAction = iota
+	// Stop gives up watching firebase
+	Stop
+	// RefreshCredentials gets new reference with FirebaseOptions.Refresh and
+	// connects again after backoff delay
+	RefreshCredentials
+)
+
+// ErrorPolicy decides what to do with error that ended connection to
+// firebase. State is the connection state before the failure.
+type ErrorPolicy func(err *Error, state ConnectionState) ErrorAction
+
+// DefaultErrorPolicy stops on permission errors, as retrying won't help
+// until security rules change, refreshes credentials on auth errors, and
+// retries on anything else
+func DefaultErrorPolicy(err *Error, state ConnectionState) ErrorAction {
+	switch err.Kind {
+	case PermissionError:
+		return Stop
+	case AuthError:
+		return RefreshCredentials
+	}
+
+	return Retry
+}
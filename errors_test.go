@@ -0,0 +1,27 @@
+package firebasehelpers
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKindOf(t *testing.T) {
+	err := errors.Wrap(errorf(PermissionError, "streaming cancelled"), "backoff")
+
+	assert.Equal(t, PermissionError, KindOf(err))
+	assert.Equal(t, "backoff: streaming cancelled", err.Error())
+	assert.Equal(t, "streaming cancelled", errors.Cause(err).Error())
+	assert.Equal(t, TransientError, KindOf(errors.New("boom")))
+	assert.Equal(t, "permission", PermissionError.String())
+}
+
+func TestDefaultErrorPolicy(t *testing.T) {
+	state := ConnectionState{Status: Connected}
+
+	assert.Equal(t, Stop, DefaultErrorPolicy(errorf(PermissionError, "cancelled"), state))
+	assert.Equal(t, RefreshCredentials, DefaultErrorPolicy(errorf(AuthError, "revoked"), state))
+	assert.Equal(t, Retry, DefaultErrorPolicy(errorf(TransientError, "ended"), state))
+	assert.Equal(t, Retry, DefaultErrorPolicy(errorf(ProtocolError, "unknown"), state))
+}
@@ -0,0 +1,47 @@
+package firebasehelpers
+
+// EventKind tells how value at matched path has changed
+type EventKind int
+
+const (
+	// Added means there was no value at the path before
+	Added EventKind = iota
+	// Changed means the path had different value before
+	Changed
+	// Removed means there is no value at the path anymore
+	Removed
+	// Moved means the path has changed its position in ordered query
+	Moved
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Changed:
+		return "changed"
+	case Removed:
+		return "removed"
+	case Moved:
+		return "moved"
+	}
+
+	return "unknown"
+}
+
+// Event describes change of value at path matched by listener's pattern
+type Event struct {
+	Kind EventKind
+	Path []string
+	// Prev is nil for Added events
+	Prev []byte
+	// Curr is nil for Removed events
+	Curr []byte
+	// Bindings holds keys matched by named captures like "$id" in the pattern
+	Bindings map[string]string
+	// PrevKey is key of the previous sibling in ordered listeners and queries,
+	// or empty string if the child is first. It's not set for Removed events.
+	PrevKey string
+	// Revision is number of values processed by the stream so far
+	Revision uint64
+}
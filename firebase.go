@@ -0,0 +1,159 @@
+package firebasehelpers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/knq/firebase"
+)
+
+// FirebaseOptions configures watching firebase with WatchFirebaseWith. HTTP
+// connection isn't configured here, as it's owned by firebase.DatabaseRef
+// passed to WatchFirebaseWith or returned by Refresh, and it's created before
+// the stream sees it. Use HTTPOptions.Option when creating the reference.
+type FirebaseOptions struct {
+	// Query limits streamed children of the watched reference, see
+	// WatchFirebaseQuery
+	Query *Query
+
+	// Backoff decides delays between reconnection attempts. It's reset after
+	// each successful connection. Exponential backoff without time limit is
+	// used by default.
+	Backoff backoff.BackOff
+
+	// MaxRetryDuration makes the stream give up reconnecting after failing for
+	// that long, counting from the first failure since the last successful
+	// connection. Zero means forever.
+	MaxRetryDuration time.Duration
+
+	// ErrorPolicy decides whether to retry after connection fails,
+	// DefaultErrorPolicy by default
+	ErrorPolicy ErrorPolicy
+
+	// Refresh returns reference with new credentials when ErrorPolicy asks
+	// for it. Without it connection is retried with the same reference.
+	Refresh func(ctx context.Context) (*firebase.DatabaseRef, error)
+
+	// InitialKeepAlive is how long to wait for the first event after
+	// connecting before the connection is considered lost, 60s by default
+	InitialKeepAlive time.Duration
+
+	// KeepAlive is how long to wait for each next event, 40s by default.
+	// Firebase sends keep-alive events every 30 seconds.
+	KeepAlive time.Duration
+}
+
+func (o FirebaseOptions) withDefaults() FirebaseOptions {
+	if o.Backoff == nil {
+		bf := backoff.NewExponentialBackOff()
+		bf.MaxElapsedTime = 0
+		o.Backoff = bf
+	}
+
+	if o.ErrorPolicy == nil {
+		o.ErrorPolicy = DefaultErrorPolicy
+	}
+
+	if o.InitialKeepAlive == 0 {
+		o.InitialKeepAlive = 60 * time.Second
+	}
+
+	if o.KeepAlive == 0 {
+		o.KeepAlive = 40 * time.Second
+	}
+
+	return o
+}
+
+// Stops backoff after failing for too long. Time is counted from the first
+// failure after backoff has been reset by successful attempt.
+type retryLimit struct {
+	backoff.BackOff
+	max   time.Duration
+	since time.Time
+}
+
+func (b *retryLimit) NextBackOff() time.Duration {
+	if b.since.IsZero() {
+		b.since = time.Now()
+	}
+
+	if b.max > 0 && time.Since(b.since) >= b.max {
+		return backoff.Stop
+	}
+
+	return b.BackOff.NextBackOff()
+}
+
+func (b *retryLimit) Reset() {
+	b.since = time.Time{}
+	b.BackOff.Reset()
+}
+
+// HTTPOptions configures HTTP connections to firebase. The connection is
+// owned by firebase.DatabaseRef, so these options are passed when creating
+// it, for example firebase.NewDatabaseRef(firebase.URL(u), opts.Option()).
+type HTTPOptions struct {
+	// Transport makes the requests, http.DefaultTransport by default
+	Transport http.RoundTripper
+
+	// Client provides Transport if it isn't set. Only transport of the client
+	// is used, as firebase.DatabaseRef makes its own client, and client's
+	// Timeout would end streaming requests anyway.
+	Client *http.Client
+
+	// Proxy selects proxy for each request, for example
+	// http.ProxyURL(u). It's used only if Transport is nil or *http.Transport.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// UserAgent is sent in User-Agent header of each request if not empty
+	UserAgent string
+}
+
+// RoundTripper returns transport making requests as configured
+func (o HTTPOptions) RoundTripper() http.RoundTripper {
+	transport := o.Transport
+
+	if transport == nil && o.Client != nil {
+		transport = o.Client.Transport
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if o.Proxy != nil {
+		if t, ok := transport.(*http.Transport); ok {
+			t = t.Clone()
+			t.Proxy = o.Proxy
+			transport = t
+		}
+	}
+
+	if o.UserAgent != "" {
+		transport = &userAgentTransport{transport, o.UserAgent}
+	}
+
+	return transport
+}
+
+// Option returns option for firebase.NewDatabaseRef using RoundTripper
+func (o HTTPOptions) Option() firebase.Option {
+	return firebase.Transport(o.RoundTripper())
+}
+
+type userAgentTransport struct {
+	transport http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+
+	return t.transport.RoundTrip(req)
+}
@@ -0,0 +1,456 @@
+package firebasehelpers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/knq/firebase"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryLimit(t *testing.T) {
+	bf := &retryLimit{BackOff: &backoff.ZeroBackOff{}, max: 50 * time.Millisecond}
+	bf.Reset()
+
+	assert.Equal(t, time.Duration(0), bf.NextBackOff())
+
+	time.Sleep(60 * time.Millisecond)
+
+	assert.Equal(t, backoff.Stop, bf.NextBackOff())
+
+	bf.Reset()
+
+	assert.Equal(t, time.Duration(0), bf.NextBackOff())
+}
+
+func TestRetryLimitForever(t *testing.T) {
+	bf := &retryLimit{BackOff: &backoff.ConstantBackOff{Interval: time.Second}}
+	bf.since = time.Now().Add(-time.Hour)
+
+	assert.Equal(t, time.Second, bf.NextBackOff())
+}
+
+func TestFirebaseOptionsDefaults(t *testing.T) {
+	options := FirebaseOptions{KeepAlive: time.Minute}.withDefaults()
+
+	assert.NotNil(t, options.Backoff)
+	assert.Equal(t, 60*time.Second, options.InitialKeepAlive)
+	assert.Equal(t, time.Minute, options.KeepAlive)
+}
+
+func TestHTTPOptions(t *testing.T) {
+	var requested *http.Request
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requested = req
+	}))
+	defer server.Close()
+
+	proxy, _ := url.Parse(server.URL)
+
+	client := &http.Client{Transport: HTTPOptions{
+		Proxy:     http.ProxyURL(proxy),
+		UserAgent: "helpers/1.0",
+	}.RoundTripper()}
+
+	req, _ := http.NewRequest("GET", "http://example.firebaseio.test/foo.json", nil)
+	res, err := client.Do(req)
+
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal(t, "helpers/1.0", requested.Header.Get("User-Agent"))
+	assert.Equal(t, "example.firebaseio.test", requested.Host)
+	assert.Empty(t, req.Header.Get("User-Agent"))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHTTPOptionsClient(t *testing.T) {
+	var userAgent string
+
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		userAgent = req.Header.Get("User-Agent")
+		return nil, errors.New("done")
+	})}
+
+	req, _ := http.NewRequest("GET", "http://example.firebaseio.test/foo.json", nil)
+	_, err := HTTPOptions{Client: client, UserAgent: "helpers/1.0"}.RoundTripper().RoundTrip(req)
+
+	assert.EqualError(t, err, "done")
+	assert.Equal(t, "helpers/1.0", userAgent)
+}
+
+// Serves firebase streaming protocol to one connection
+type eventWriter struct {
+	http.ResponseWriter
+	req    *http.Request
+	opened bool
+}
+
+// Sends response headers, so the client sees connection established
+func (w *eventWriter) open() {
+	if w.opened {
+		return
+	}
+
+	w.opened = true
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *eventWriter) send(event string, data string) {
+	w.open()
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Waits until ch is closed or client disconnects
+func (w *eventWriter) wait(ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-w.req.Context().Done():
+	}
+}
+
+// Keeps connection open until client disconnects
+func (w *eventWriter) hold() {
+	w.open()
+	w.wait(nil)
+}
+
+// Returns server calling serve for each connection with its number, and
+// reference watching "players" on it. Connection ends when serve returns.
+func newFirebaseServer(t *testing.T, serve func(conn int, w *eventWriter)) (*httptest.Server, *firebase.DatabaseRef) {
+	var conns int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		serve(int(atomic.AddInt32(&conns, 1)-1), &eventWriter{ResponseWriter: rw, req: req})
+	}))
+
+	ref, err := firebase.NewDatabaseRef(firebase.URL(server.URL + "/players"))
+
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return server, ref
+}
+
+func waitForValue(t *testing.T, stream *Stream, expected string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := stream.Select().WaitFor(ctx, func(s Snapshot) bool {
+		return string(stream.Select().Value()) == expected
+	})
+
+	assert.NoError(t, err, "expected %s, got %s", expected, stream.Select().Value())
+}
+
+func waitForConnection(t *testing.T, stream *Stream, status ConnectionStatus, attempt int) ConnectionState {
+	assert.Eventually(t, func() bool {
+		state := stream.ConnectionState()
+		return state.Status == status && state.Attempt == attempt
+	}, 5*time.Second, time.Millisecond, "expected %s after %d attempts", status, attempt)
+
+	return stream.ConnectionState()
+}
+
+func TestWatchFirebaseQuery(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	requests := make(chan *http.Request, 1)
+
+	server, ref := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		requests <- w.req
+
+		w.send("put", `{"path":"/","data":{"a":1,"b":2}}`)
+		w.send("patch", `{"path":"/","data":{"a":3,"c":4}}`)
+		w.send("put", `{"path":"/a","data":5}`)
+		w.send("put", `{"path":"/d","data":6}`)
+		w.hold()
+	})
+	defer server.Close()
+
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	}).WatchFirebaseWith(ref, FirebaseOptions{Query: NewQuery(OrderByKey()).StartAt("b")})
+	defer stream.Shutdown()
+
+	req := <-requests
+
+	assert.Equal(t, "/players.json", req.URL.Path)
+	assert.Equal(t, "text/event-stream", req.Header.Get("Accept"))
+	assert.Equal(t, url.Values{"orderBy": {`"$key"`}, "startAt": {`"b"`}}, req.URL.Query())
+
+	// Children outside of the query are pruned from puts and patches
+	waitForValue(t, stream, `{"b":2,"c":4,"d":6}`)
+}
+
+func TestWatchFirebaseConnectionState(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	accept := []chan struct{}{make(chan struct{}), make(chan struct{})}
+	drop := make(chan struct{})
+
+	server, ref := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		w.wait(accept[conn])
+
+		w.send("put", fmt.Sprintf(`{"path":"/","data":{"a":%d}}`, conn))
+
+		if conn == 0 {
+			w.wait(drop)
+			return
+		}
+
+		w.hold()
+	})
+	defer server.Close()
+
+	errs := make(chan error, 10)
+
+	stream := NewStream(func(err error) {
+		errs <- err
+	}).WatchFirebaseWith(ref, FirebaseOptions{Backoff: &backoff.ConstantBackOff{Interval: 100 * time.Millisecond}})
+	defer stream.Shutdown()
+
+	waitForConnection(t, stream, Connecting, 0)
+	close(accept[0])
+
+	waitForValue(t, stream, `{"a":0}`)
+	waitForConnection(t, stream, Connected, 0)
+
+	close(drop)
+
+	state := waitForConnection(t, stream, Reconnecting, 1)
+
+	assert.EqualError(t, state.LastError, "streaming ended")
+	assert.False(t, state.NextRetry.IsZero())
+	assert.EqualError(t, <-errs, "streaming ended")
+
+	state = waitForConnection(t, stream, Connecting, 1)
+
+	assert.True(t, state.NextRetry.IsZero())
+
+	close(accept[1])
+
+	waitForValue(t, stream, `{"a":1}`)
+	waitForConnection(t, stream, Connected, 0)
+
+	assert.NoError(t, stream.Close())
+	assert.Equal(t, Disconnected, stream.ConnectionState().Status)
+}
+
+func TestWatchFirebaseKeepAlive(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	server, ref := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		w.send("put", `{"path":"/","data":{"a":1}}`)
+
+		// Any event postpones the deadline
+		for i := 0; i < 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			w.send("keep-alive", "null")
+		}
+
+		w.hold()
+	})
+	defer server.Close()
+
+	errs := make(chan error, 10)
+
+	stream := NewStream(func(err error) {
+		errs <- err
+	}).WatchFirebaseWith(ref, FirebaseOptions{
+		Backoff:          &backoff.ConstantBackOff{Interval: time.Hour},
+		InitialKeepAlive: 50 * time.Millisecond,
+		KeepAlive:        50 * time.Millisecond,
+	})
+
+	started := time.Now()
+	err := <-errs
+
+	assert.EqualError(t, err, "failed to receive keep-alive signal")
+	assert.Equal(t, TransientError, KindOf(err))
+	assert.True(t, time.Since(started) >= 100*time.Millisecond)
+
+	// Failure that's being retried is reported by Close
+	err = stream.Close()
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "backoff: closed while reconnecting: failed to receive keep-alive signal")
+}
+
+func TestWatchFirebaseErrorPolicyStop(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	var conns int32
+
+	server, ref := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		atomic.AddInt32(&conns, 1)
+
+		w.send("put", `{"path":"/","data":{"a":1}}`)
+		w.send("cancel", "null")
+		w.hold()
+	})
+	defer server.Close()
+
+	errs := make(chan error, 10)
+
+	stream := NewStream(func(err error) {
+		errs <- err
+	}).WatchFirebaseWith(ref, FirebaseOptions{Backoff: &backoff.ConstantBackOff{Interval: 10 * time.Millisecond}})
+	defer stream.Shutdown()
+
+	err := <-errs
+
+	assert.EqualError(t, err, "backoff: gave up reconnecting: streaming cancelled")
+	assert.Equal(t, PermissionError, KindOf(err))
+
+	state := waitForConnection(t, stream, Disconnected, 0)
+
+	assert.EqualError(t, state.LastError, "streaming cancelled")
+	assert.NoError(t, stream.Close())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+func TestWatchFirebaseRefreshCredentials(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	revoked, ref := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		w.send("put", `{"path":"/","data":{"a":1}}`)
+		w.send("auth_revoked", `"token expired"`)
+		w.hold()
+	})
+	defer revoked.Close()
+
+	refreshed, fresh := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		w.send("put", `{"path":"/","data":{"a":2}}`)
+		w.hold()
+	})
+	defer refreshed.Close()
+
+	var refreshes int32
+	errs := make(chan error, 10)
+
+	stream := NewStream(func(err error) {
+		errs <- err
+	}).WatchFirebaseWith(ref, FirebaseOptions{
+		Backoff: &backoff.ConstantBackOff{Interval: 10 * time.Millisecond},
+		Refresh: func(ctx context.Context) (*firebase.DatabaseRef, error) {
+			atomic.AddInt32(&refreshes, 1)
+			return fresh, nil
+		},
+	})
+	defer stream.Shutdown()
+
+	err := <-errs
+
+	assert.EqualError(t, err, "streaming auth revoked")
+	assert.Equal(t, AuthError, KindOf(err))
+
+	// Reconnects with the refreshed reference
+	waitForValue(t, stream, `{"a":2}`)
+	waitForConnection(t, stream, Connected, 0)
+
+	assert.NoError(t, stream.Close())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshes))
+	assert.Empty(t, errs)
+}
+
+func TestWatchFirebaseMaxRetryDuration(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	server, ref := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	defer server.Close()
+
+	errs := make(chan error, 100)
+
+	stream := NewStream(func(err error) {
+		errs <- err
+	}).WatchFirebaseWith(ref, FirebaseOptions{
+		Backoff:          &backoff.ConstantBackOff{Interval: 10 * time.Millisecond},
+		MaxRetryDuration: 50 * time.Millisecond,
+	})
+	defer stream.Shutdown()
+
+	var err error
+
+	for err = range errs {
+		assert.Equal(t, TransientError, KindOf(err))
+
+		if strings.Contains(err.Error(), "gave up") {
+			break
+		}
+	}
+
+	assert.Contains(t, err.Error(), "backoff: gave up reconnecting: failed to watch")
+
+	// State is updated before giving up is reported
+	state := stream.ConnectionState()
+
+	assert.Equal(t, Disconnected, state.Status)
+	assert.True(t, state.Attempt > 1)
+	assert.NoError(t, stream.Close())
+}
+
+func TestWatchFirebaseUnsyncOnReconnect(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	reconnect := make(chan struct{})
+	drop := make(chan struct{})
+
+	server, ref := newFirebaseServer(t, func(conn int, w *eventWriter) {
+		if conn == 0 {
+			w.send("put", `{"path":"/","data":{"a":1}}`)
+			w.wait(drop)
+			return
+		}
+
+		w.wait(reconnect)
+		w.send("put", `{"path":"/","data":{"a":2}}`)
+		w.hold()
+	})
+	defer server.Close()
+
+	stream := NewStreamContext(context.Background(), StreamOptions{
+		UnsyncOnReconnect: true,
+		ErrHandler:        func(err error) {},
+	}).WatchFirebaseWith(ref, FirebaseOptions{Backoff: &backoff.ConstantBackOff{Interval: 10 * time.Millisecond}})
+	defer stream.Shutdown()
+
+	<-stream.Ready()
+
+	assert.True(t, stream.IsSynced())
+
+	close(drop)
+
+	waitForConnection(t, stream, Connecting, 1)
+
+	assert.False(t, stream.IsSynced())
+
+	close(reconnect)
+
+	// Initial data of the new connection syncs the stream again
+	assert.Eventually(t, stream.IsSynced, 5*time.Second, time.Millisecond)
+
+	waitForValue(t, stream, `{"a":2}`)
+}
@@ -0,0 +1,126 @@
+package firebasehelpers
+
+import "sort"
+
+// Trie of listener patterns, used to find listeners that could be affected by
+// changes at given paths without matching each of them separately
+type patternIndex struct {
+	children  map[string]*patternIndex
+	listeners []*Listener
+}
+
+func newPatternIndex() *patternIndex {
+	return &patternIndex{children: map[string]*patternIndex{}}
+}
+
+// All wildcards share the same node
+func indexKey(segment string) string {
+	if isWildcard(segment) {
+		return "*"
+	}
+
+	return segment
+}
+
+func (n *patternIndex) add(pattern []string, listener *Listener) {
+	if len(pattern) == 0 {
+		n.listeners = append(n.listeners, listener)
+		return
+	}
+
+	key := indexKey(pattern[0])
+	child, ok := n.children[key]
+
+	if !ok {
+		child = newPatternIndex()
+		n.children[key] = child
+	}
+
+	child.add(pattern[1:], listener)
+}
+
+// Removes listener and returns true if node has become empty
+func (n *patternIndex) remove(pattern []string, listener *Listener) bool {
+	if len(pattern) == 0 {
+		for i, l := range n.listeners {
+			if l == listener {
+				n.listeners = remove(n.listeners, i)
+				break
+			}
+		}
+	} else if child, ok := n.children[indexKey(pattern[0])]; ok {
+		if child.remove(pattern[1:], listener) {
+			delete(n.children, indexKey(pattern[0]))
+		}
+	}
+
+	return len(n.listeners) == 0 && len(n.children) == 0
+}
+
+func (n *patternIndex) collectAll(found map[*Listener]struct{}) {
+	for _, listener := range n.listeners {
+		found[listener] = struct{}{}
+	}
+
+	for _, child := range n.children {
+		child.collectAll(found)
+	}
+}
+
+// Collects listeners with patterns intersecting path
+func (n *patternIndex) collect(path []string, found map[*Listener]struct{}) {
+	if len(path) == 0 {
+		n.collectAll(found)
+		return
+	}
+
+	// Patterns that are shorter than path match its ancestor
+	for _, listener := range n.listeners {
+		found[listener] = struct{}{}
+	}
+
+	if child, ok := n.children[path[0]]; ok {
+		child.collect(path[1:], found)
+	}
+
+	if child, ok := n.children["*"]; ok && path[0] != "*" {
+		child.collect(path[1:], found)
+	}
+
+	// Recursive wildcard can consume any number of keys
+	if child, ok := n.children["**"]; ok {
+		for i := 0; i <= len(path); i++ {
+			child.collect(path[i:], found)
+		}
+	}
+}
+
+// Returns listeners affected by changes at given paths, together with extra
+// listeners, in registration order
+func (n *patternIndex) affected(paths [][]string, extra ...*Listener) []*Listener {
+	found := map[*Listener]struct{}{}
+
+	for _, listener := range extra {
+		found[listener] = struct{}{}
+	}
+
+	if len(paths) == 0 {
+		n.collectAll(found)
+	}
+
+	for _, path := range paths {
+		n.collect(path, found)
+	}
+
+	result := make([]*Listener, 0, len(found))
+
+	for listener := range found {
+		result = append(result, listener)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].id < result[j].id
+	})
+
+	return result
+}
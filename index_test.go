@@ -0,0 +1,74 @@
+package firebasehelpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatternIndexAffected(t *testing.T) {
+	index := newPatternIndex()
+
+	supervisors := &Listener{id: 1}
+	managers := &Listener{id: 2}
+	foo := &Listener{id: 3}
+	workers := &Listener{id: 4}
+
+	index.add([]string{"managers", "*", "supervisors", "*"}, supervisors)
+	index.add([]string{"managers", "*"}, managers)
+	index.add([]string{"managers", "foo"}, foo)
+	index.add([]string{"workers"}, workers)
+
+	assert.Equal(t, []*Listener{supervisors, managers, foo}, index.affected([][]string{{"managers", "foo"}}))
+	assert.Equal(t, []*Listener{supervisors, managers}, index.affected([][]string{{"managers", "bar", "supervisors"}}))
+	assert.Equal(t, []*Listener{managers}, index.affected([][]string{{"managers", "bar", "name"}}))
+	assert.Equal(t, []*Listener{supervisors, managers, foo}, index.affected([][]string{{"managers"}}))
+	assert.Equal(t, []*Listener{managers, workers}, index.affected([][]string{{"workers", "fiz"}, {"managers", "bar", "name"}}))
+	assert.Equal(t, []*Listener{supervisors, managers, foo, workers}, index.affected(nil))
+	assert.Equal(t, []*Listener{workers}, index.affected([][]string{{"clients"}}, workers))
+}
+
+func TestPatternIndexRemove(t *testing.T) {
+	index := newPatternIndex()
+
+	managers := &Listener{id: 1}
+	foo := &Listener{id: 2}
+
+	index.add([]string{"managers", "*"}, managers)
+	index.add([]string{"managers", "foo"}, foo)
+
+	assert.False(t, index.remove([]string{"managers", "*"}, managers))
+	assert.Equal(t, []*Listener{foo}, index.affected([][]string{{"managers", "foo"}}))
+
+	assert.True(t, index.remove([]string{"managers", "foo"}, foo))
+	assert.Empty(t, index.children)
+}
+
+func TestPatternIndexCaptures(t *testing.T) {
+	index := newPatternIndex()
+
+	manager := &Listener{id: 1}
+	managers := &Listener{id: 2}
+
+	index.add([]string{"managers", "$manager"}, manager)
+	index.add([]string{"managers", "*"}, managers)
+
+	assert.Equal(t, []*Listener{manager, managers}, index.affected([][]string{{"managers", "foo"}}))
+
+	index.remove([]string{"managers", "$manager"}, manager)
+
+	assert.Equal(t, []*Listener{managers}, index.affected([][]string{{"managers", "foo"}}))
+}
+
+func TestPatternIndexRecursive(t *testing.T) {
+	index := newPatternIndex()
+
+	config := &Listener{id: 1}
+	tenants := &Listener{id: 2}
+
+	index.add([]string{"**", "config"}, config)
+	index.add([]string{"tenants", "**"}, tenants)
+
+	assert.Equal(t, []*Listener{config, tenants}, index.affected([][]string{{"tenants", "foo", "config"}}))
+	assert.Equal(t, []*Listener{config}, index.affected([][]string{{"users"}}))
+}
@@ -0,0 +1,140 @@
+package firebasehelpers
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Delays events separately for each path, so frequent changes of one path
+// don't hold back events of its siblings. It's used only by the listener's
+// own goroutine, which passes current time and waits for next deadline.
+type limiter struct {
+	debounce time.Duration
+	throttle time.Duration
+	paths    map[string]*limited
+}
+
+// State of a single path. Event is waiting for delivery if pending is set.
+type limited struct {
+	event    Event
+	pending  bool
+	deadline time.Time
+}
+
+func newLimiter(debounce time.Duration, throttle time.Duration) *limiter {
+	return &limiter{
+		debounce: debounce,
+		throttle: throttle,
+		paths:    map[string]*limited{},
+	}
+}
+
+// Takes event received at given time and returns events to deliver right away
+func (l *limiter) add(event Event, now time.Time) []Event {
+	key := strings.Join(event.Path, "/")
+	p := l.paths[key]
+
+	if l.debounce > 0 {
+		if p == nil {
+			p = &limited{}
+			l.paths[key] = p
+		}
+
+		p.merge(event)
+		p.deadline = now.Add(l.debounce)
+
+		return nil
+	}
+
+	// Throttled path delivers the first event immediately and then waits
+	if p == nil {
+		l.paths[key] = &limited{deadline: now.Add(l.throttle)}
+		return []Event{event}
+	}
+
+	p.merge(event)
+
+	return nil
+}
+
+// Merges event with the one waiting for delivery, if there is any
+func (p *limited) merge(event Event) {
+	if !p.pending {
+		p.event = event
+		p.pending = true
+		return
+	}
+
+	p.event, p.pending = mergeEvents(p.event, event)
+}
+
+// Returns time of the earliest deadline, or false if no path waits for one
+func (l *limiter) next() (time.Time, bool) {
+	var result time.Time
+
+	for _, p := range l.paths {
+		if result.IsZero() || p.deadline.Before(result) {
+			result = p.deadline
+		}
+	}
+
+	return result, !result.IsZero()
+}
+
+// Returns events of paths whose deadline has passed at given time. Debounced
+// path is delivered after quiet period, throttled path at the end of each
+// interval until it stops changing.
+func (l *limiter) due(now time.Time) []Event {
+	var events []Event
+
+	for _, key := range l.keys() {
+		p := l.paths[key]
+
+		if p.deadline.After(now) {
+			continue
+		}
+
+		if p.pending {
+			events = append(events, p.event)
+		}
+
+		if l.debounce > 0 || !p.pending {
+			delete(l.paths, key)
+			continue
+		}
+
+		p.pending = false
+		p.deadline = now.Add(l.throttle)
+	}
+
+	return events
+}
+
+// Returns all waiting events immediately and forgets about deadlines
+func (l *limiter) flush() []Event {
+	var events []Event
+
+	for _, key := range l.keys() {
+		if p := l.paths[key]; p.pending {
+			events = append(events, p.event)
+		}
+	}
+
+	l.paths = map[string]*limited{}
+
+	return events
+}
+
+// Returns limited paths in order, so events due at once are delivered in it
+func (l *limiter) keys() []string {
+	keys := make([]string, 0, len(l.paths))
+
+	for key := range l.paths {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,110 @@
+package firebasehelpers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns path and value of each event
+func values(events []Event) []string {
+	result := []string{}
+
+	for _, event := range events {
+		result = append(result, event.Path[0]+"="+string(event.Curr))
+	}
+
+	return result
+}
+
+func TestLimiterDebounce(t *testing.T) {
+	start := time.Now()
+	limit := newLimiter(30*time.Millisecond, 0)
+
+	assert.Empty(t, limit.add(Event{Kind: Added, Path: []string{"foo"}, Curr: []byte("1")}, start))
+	assert.Empty(t, limit.add(Event{Kind: Added, Path: []string{"bar"}, Curr: []byte("1")}, start))
+	assert.Empty(t, limit.add(Event{Kind: Removed, Path: []string{"bar"}, Prev: []byte("1")}, start))
+
+	next, ok := limit.next()
+
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(30*time.Millisecond), next)
+
+	// Change during quiet period postpones the event
+	assert.Empty(t, limit.add(Event{Kind: Changed, Path: []string{"foo"}, Prev: []byte("1"), Curr: []byte("2")}, start.Add(20*time.Millisecond)))
+	assert.Empty(t, limit.due(start.Add(30*time.Millisecond)))
+
+	events := limit.due(start.Add(50 * time.Millisecond))
+
+	assert.Equal(t, []string{"foo=2"}, values(events))
+	assert.Equal(t, Added, events[0].Kind)
+
+	_, ok = limit.next()
+
+	assert.False(t, ok)
+}
+
+func TestLimiterThrottle(t *testing.T) {
+	start := time.Now()
+	limit := newLimiter(0, 50*time.Millisecond)
+
+	// Leading events of each path are delivered immediately
+	assert.Equal(t, []string{"foo=1"}, values(limit.add(Event{Kind: Added, Path: []string{"foo"}, Curr: []byte("1")}, start)))
+	assert.Empty(t, limit.add(Event{Kind: Changed, Path: []string{"foo"}, Prev: []byte("1"), Curr: []byte("2")}, start))
+	assert.Empty(t, limit.add(Event{Kind: Changed, Path: []string{"foo"}, Prev: []byte("2"), Curr: []byte("3")}, start))
+	assert.Equal(t, []string{"bar=1"}, values(limit.add(Event{Kind: Added, Path: []string{"bar"}, Curr: []byte("1")}, start.Add(10*time.Millisecond))))
+
+	// Trailing event is delivered at the end of interval
+	events := limit.due(start.Add(50 * time.Millisecond))
+
+	assert.Equal(t, []string{"foo=3"}, values(events))
+	assert.Equal(t, []byte("1"), events[0].Prev)
+
+	// Paths that stopped changing are forgotten after their interval
+	assert.Empty(t, limit.due(start.Add(100*time.Millisecond)))
+	assert.Empty(t, limit.paths)
+}
+
+func TestLimiterFlush(t *testing.T) {
+	start := time.Now()
+	limit := newLimiter(time.Hour, 0)
+
+	limit.add(Event{Kind: Added, Path: []string{"foo"}, Curr: []byte("1")}, start)
+	limit.add(Event{Kind: Added, Path: []string{"bar"}, Curr: []byte("1")}, start)
+
+	assert.Equal(t, []string{"bar=1", "foo=1"}, values(limit.flush()))
+	assert.Empty(t, limit.flush())
+}
+
+func TestListenDebounce(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	events := make(chan Event, 10)
+
+	stream.ListenWith([]string{"counters", "*"}, ListenOptions{Debounce: 50 * time.Millisecond}, func(event Event) {
+		events <- event
+	})
+
+	stream.Push([]byte(`{"counters":{"foo":1}}`))
+	stream.Push([]byte(`{"counters":{"foo":2}}`))
+	stream.Push([]byte(`{"counters":{"foo":3}}`))
+
+	event := <-events
+
+	assert.Equal(t, Added, event.Kind)
+	assert.Equal(t, []byte("3"), event.Curr)
+
+	stream.Push([]byte(`{"counters":{"foo":4}}`))
+	stream.Close()
+
+	// Waiting events are delivered when listener is removed
+	event = <-events
+
+	assert.Equal(t, Removed, event.Kind)
+	assert.Equal(t, []byte("3"), event.Prev)
+	assert.Empty(t, events)
+}
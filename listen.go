@@ -0,0 +1,181 @@
+package firebasehelpers
+
+import "time"
+
+// ListenOptions configures listener created with ListenWith
+type ListenOptions struct {
+	// Async makes callback run on listener's own goroutine, so slow callback
+	// doesn't delay other listeners. Events are still delivered in order.
+	Async bool
+	// Debounce delays events of each matched path until it doesn't change for
+	// that long, and then delivers them merged into one. It implies Async.
+	Debounce time.Duration
+	// Throttle delivers at most one event of each matched path per interval.
+	// Changes made during the interval are merged and delivered at its end.
+	// It implies Async and is ignored if Debounce is set.
+	Throttle time.Duration
+	// Buffer is number of events waiting for async callback, 64 if not set
+	Buffer int
+	// Overflow tells what happens with events when buffer is full,
+	// OverflowCoalesce by default, so callback doesn't miss any change but
+	// can delay other listeners when many paths change at once.
+	Overflow Overflow
+}
+
+// ListenWith is like ListenEvents, but allows to configure how events are
+// delivered to the callback
+func (c *Stream) ListenWith(pattern []string, opts ListenOptions, cb func(Event)) *Listener {
+	return c.listenWith(c.Select(pattern...), opts, cb)
+}
+
+func (w *Stream) listenWith(cursor *cursor, opts ListenOptions, cb func(Event)) *Listener {
+	if !opts.Async && opts.Debounce <= 0 && opts.Throttle <= 0 {
+		return w.listen(cursor, cb)
+	}
+
+	size := opts.Buffer
+
+	if size <= 0 {
+		size = 64
+	}
+
+	queue := newEventQueue(size, opts.Overflow.or(OverflowCoalesce), func(event Event) {
+		cursor.stream.dropEvent(cursor, event)
+	})
+
+	listener := &Listener{cursor: cursor, stopped: make(chan struct{})}
+
+	listener.cb = func(event Event) {
+		queue.push(event, listener.stopped)
+	}
+
+	var limit *limiter
+
+	if opts.Debounce > 0 || opts.Throttle > 0 {
+		limit = newLimiter(opts.Debounce, opts.Throttle)
+	}
+
+	cursor.stream.Async(func() {
+		listener.run(queue, limit, cb)
+	}, "listener")
+
+	return w.add(listener)
+}
+
+// Delivers queued events until listener is removed. Limiter is used only by
+// this goroutine, which waits for its deadlines together with new events, so
+// events waiting in it are delivered when listener is removed.
+func (w *Listener) run(queue *eventQueue, limit *limiter, cb func(Event)) {
+	var timer *time.Timer
+	var deadline <-chan time.Time
+
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	// Passes events through limiter, if there's one
+	take := func() bool {
+		for {
+			event, ok := queue.pop()
+
+			if !ok {
+				return true
+			}
+
+			events := []Event{event}
+
+			if limit != nil {
+				events = limit.add(event, time.Now())
+			}
+
+			if !w.deliverAll(cb, events) {
+				return false
+			}
+		}
+	}
+
+	for {
+		if !take() {
+			return
+		}
+
+		if limit != nil {
+			if timer != nil {
+				timer.Stop()
+			}
+
+			deadline = nil
+
+			if at, ok := limit.next(); ok {
+				timer = time.NewTimer(time.Until(at))
+				deadline = timer.C
+			}
+		}
+
+		select {
+		case <-queue.signal:
+		case <-deadline:
+			if !w.deliverAll(cb, limit.due(time.Now())) {
+				return
+			}
+		case <-w.stopped:
+			// Deliver events queued before listener was removed
+			if take() && limit != nil {
+				w.deliverAll(cb, limit.flush())
+			}
+
+			return
+		}
+	}
+}
+
+// Delivers events in order and tells if listener is still active
+func (w *Listener) deliverAll(cb func(Event), events []Event) bool {
+	for _, event := range events {
+		if !w.deliver(cb, event) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Calls cb on async listener's goroutine and tells if listener is still active
+func (w *Listener) deliver(cb func(Event), event Event) (active bool) {
+	defer func() {
+		if rec := recover(); rec != nil && w.panicked(event.Path, rec) {
+			w.stop()
+			w.cursor.stream.detachLater(w)
+			active = false
+		}
+	}()
+
+	cb(event)
+
+	return true
+}
+
+func (w *Listener) stop() {
+	if w.stopped == nil {
+		return
+	}
+
+	w.stopOnce.Do(func() {
+		close(w.stopped)
+	})
+}
+
+func (w *Listener) isStopped() bool {
+	if w.stopped == nil {
+		return false
+	}
+
+	select {
+	case <-w.stopped:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,230 @@
+package firebasehelpers
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenAsync(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slow := make(chan string, 10)
+	fast := make(chan string, 10)
+
+	stream.ListenWith([]string{"foo"}, ListenOptions{Async: true}, func(event Event) {
+		notify(started)
+		<-release
+		slow <- event.Kind.String() + " " + string(event.Curr)
+	})
+
+	stream.Listen([]string{"foo"}, func(path []string, prev []byte, curr []byte) {
+		fast <- string(curr)
+	})
+
+	stream.Push([]byte(`{"foo":1}`))
+
+	<-started
+
+	stream.Push([]byte(`{"foo":2}`))
+	stream.Push([]byte(`{"foo":3}`))
+
+	// Fast listener isn't delayed by the slow one
+	assert.Equal(t, "1", <-fast)
+	assert.Equal(t, "2", <-fast)
+	assert.Equal(t, "3", <-fast)
+
+	close(release)
+
+	// Waiting changes of one path are merged by default
+	assert.Equal(t, "added 1", <-slow)
+	assert.Equal(t, "changed 3", <-slow)
+
+	stream.Close()
+
+	// Removal on shutdown is delivered as well
+	assert.Equal(t, "removed ", <-slow)
+}
+
+func TestListenAsyncOverflow(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	errs := make(chan error, 10)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{
+		Strict: true,
+		ErrHandler: func(err error) {
+			errs <- err
+		},
+	})
+	defer stream.Shutdown()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	events := make(chan string, 10)
+
+	stream.ListenWith([]string{"foo"}, ListenOptions{Async: true, Buffer: 1, Overflow: OverflowDropOldest}, func(event Event) {
+		if event.Kind == Added {
+			close(started)
+			<-release
+		}
+
+		events <- string(event.Curr)
+	})
+
+	stream.Push([]byte(`{"foo":1}`))
+
+	<-started
+
+	stream.Push([]byte(`{"foo":2}`))
+	stream.Push([]byte(`{"foo":3}`))
+
+	// Events of previous values are queued once the next one is processed
+	stream.Push([]byte(`{"foo":3,"bar":1}`))
+	stream.Select().WaitFor(context.Background(), func(s Snapshot) bool {
+		return s.Revision() == 4
+	})
+
+	close(release)
+
+	assert.Equal(t, "1", <-events)
+	assert.Equal(t, "3", <-events)
+
+	// Dropped event is reported and counted
+	err := <-errs
+	assert.EqualError(t, err, "listener for foo dropped changed event at foo")
+	assert.Equal(t, OverflowError, KindOf(err))
+	assert.Equal(t, uint64(1), stream.Stats().DroppedEvents)
+}
+
+func TestListenAsyncCoalescesByDefault(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{
+		Strict: true,
+		ErrHandler: func(err error) {
+			t.Error(err)
+		},
+	})
+	defer stream.Shutdown()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	events := make(chan string, 10)
+
+	stream.ListenWith([]string{"*"}, ListenOptions{Async: true, Buffer: 1}, func(event Event) {
+		if event.Kind == Added && event.Path[0] == "x" {
+			close(started)
+			<-release
+		}
+
+		events <- event.Kind.String() + " " + event.Path[0]
+	})
+
+	stream.Push([]byte(`{"x":1}`))
+
+	<-started
+
+	// Removal of a cancels out its addition, so it's never seen alone
+	stream.Push([]byte(`{"a":1,"x":1}`))
+	stream.Push([]byte(`{"x":1}`))
+	stream.Push([]byte(`{"b":1,"x":1}`))
+	stream.Select().WaitFor(context.Background(), func(s Snapshot) bool {
+		return s.Revision() == 4
+	})
+
+	close(release)
+
+	assert.Equal(t, "added x", <-events)
+	assert.Equal(t, "added b", <-events)
+
+	stream.Close()
+
+	// Removals go from the last path to the first
+	assert.Equal(t, "removed x", <-events)
+	assert.Equal(t, "removed b", <-events)
+	assert.Equal(t, uint64(0), stream.Stats().DroppedEvents)
+}
+
+func TestListenAsyncPanic(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	errs := make(chan error, 10)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{
+		MaxPanics: 1,
+		Strict:    true,
+		ErrHandler: func(err error) {
+			errs <- err
+		},
+	})
+
+	stream.ListenWith([]string{"foo"}, ListenOptions{Async: true}, func(event Event) {
+		panic("boom")
+	})
+
+	stream.Push([]byte(`{"foo":1}`))
+
+	assert.EqualError(t, <-errs, "listener for foo panicked at foo: boom")
+
+	// Listener is detached without waiting for another value
+	assert.Eventually(t, func() bool {
+		stream.processMux.Lock()
+		defer stream.processMux.Unlock()
+
+		return len(stream.listeners) == 0
+	}, time.Second, time.Millisecond)
+
+	stream.Close()
+
+	assert.Empty(t, errs)
+}
+
+func TestListenAsyncDoesNotBlockByDefault(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	slow := make(chan string, 10)
+	fast := make(chan string, 10)
+
+	stream.ListenWith([]string{"foo"}, ListenOptions{Async: true, Buffer: 1}, func(event Event) {
+		started <- struct{}{}
+		<-release
+		slow <- string(event.Curr)
+	})
+
+	stream.Listen([]string{"foo"}, func(path []string, prev []byte, curr []byte) {
+		fast <- string(curr)
+	})
+
+	stream.Push([]byte(`{"foo":1}`))
+
+	<-started
+
+	for i := 2; i <= 5; i++ {
+		stream.Push([]byte(`{"foo":` + strconv.Itoa(i) + `}`))
+	}
+
+	// Full buffer of the slow listener doesn't stop the stream
+	for i := 1; i <= 5; i++ {
+		assert.Equal(t, strconv.Itoa(i), <-fast)
+	}
+
+	close(release)
+
+	// The first event was being delivered, older waiting ones were dropped
+	assert.Equal(t, "1", <-slow)
+	assert.Equal(t, "5", <-slow)
+
+	stream.Close()
+}
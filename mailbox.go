@@ -0,0 +1,108 @@
+package firebasehelpers
+
+import "sync"
+
+// StreamStats describes how values pushed to a stream have been handled
+type StreamStats struct {
+	// Pushed is the number of values accepted by Push
+	Pushed uint64
+	// Coalesced is the number of values replaced by a newer one before processing
+	Coalesced uint64
+	// Processed is the number of values taken for processing
+	Processed uint64
+	// Pending is the number of values waiting for processing
+	Pending int
+	// DroppedErrors is the number of errors not delivered to ErrHandler
+	// because too many were waiting
+	DroppedErrors uint64
+	// DroppedEvents is the number of events dropped by listeners with
+	// OverflowDropOldest because their buffer was full
+	DroppedEvents uint64
+}
+
+// Value of the whole tree, or changes of it, along with paths that changed
+// since previous value. Ops are applied to the value if it's set, otherwise to
+// the current tree. If there are no paths then any part of the tree could
+// change. Sync is set when the value is complete data loaded from the source.
+type update struct {
+	value []byte
+	ops   []treeOp
+	paths [][]string
+	sync  bool
+}
+
+// Merges update with the one that follows it
+func (u update) merge(next update) update {
+	merged := update{value: next.value, ops: next.ops, sync: u.sync || next.sync}
+
+	// Changes made before the next value are lost anyway
+	if next.value == nil {
+		merged.value = u.value
+		merged.ops = append(u.ops[:len(u.ops):len(u.ops)], next.ops...)
+	}
+
+	if len(u.paths) > 0 && len(next.paths) > 0 {
+		merged.paths = append(u.paths[:len(u.paths):len(u.paths)], next.paths...)
+	}
+
+	return merged
+}
+
+// Holds values pushed to a stream until they're processed. By default only the
+// latest value is kept, in strict mode all of them are queued in order.
+type mailbox struct {
+	strict  bool
+	pending []update
+	signal  chan struct{}
+	stats   StreamStats
+	mux     sync.Mutex
+}
+
+func newMailbox(strict bool) *mailbox {
+	return &mailbox{
+		strict: strict,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (m *mailbox) put(u update) {
+	m.mux.Lock()
+
+	m.stats.Pushed++
+
+	if !m.strict && len(m.pending) > 0 {
+		m.pending[0] = m.pending[0].merge(u)
+		m.stats.Coalesced++
+	} else {
+		m.pending = append(m.pending, u)
+	}
+
+	m.mux.Unlock()
+
+	// Signal is buffered so the receiver never misses values put meanwhile
+	select {
+	case m.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (m *mailbox) take() []update {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	values := m.pending
+	m.pending = nil
+	m.stats.Processed += uint64(len(values))
+
+	return values
+}
+
+func (m *mailbox) Stats() StreamStats {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	stats := m.stats
+	stats.Pending = len(m.pending)
+
+	return stats
+}
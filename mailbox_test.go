@@ -0,0 +1,89 @@
+package firebasehelpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMailboxCoalesces(t *testing.T) {
+	box := newMailbox(false)
+
+	box.put(update{value: []byte("1")})
+	box.put(update{value: []byte("2")})
+	box.put(update{value: []byte("3")})
+
+	assert.Equal(t, StreamStats{Pushed: 3, Coalesced: 2, Pending: 1}, box.Stats())
+	assert.Equal(t, []update{{value: []byte("3")}}, box.take())
+	assert.Equal(t, StreamStats{Pushed: 3, Coalesced: 2, Processed: 1}, box.Stats())
+	assert.Nil(t, box.take())
+}
+
+func TestMailboxStrict(t *testing.T) {
+	box := newMailbox(true)
+
+	box.put(update{value: []byte("1")})
+	box.put(update{value: []byte("2")})
+	box.put(update{value: []byte("3")})
+
+	assert.Equal(t, StreamStats{Pushed: 3, Pending: 3}, box.Stats())
+	assert.Equal(t, []update{{value: []byte("1")}, {value: []byte("2")}, {value: []byte("3")}}, box.take())
+	assert.Equal(t, StreamStats{Pushed: 3, Processed: 3}, box.Stats())
+}
+
+func TestMailboxSignal(t *testing.T) {
+	box := newMailbox(false)
+
+	box.put(update{value: []byte("1")})
+	box.put(update{value: []byte("2")})
+
+	<-box.signal
+
+	select {
+	case <-box.signal:
+		t.Error("Signal should be sent once for values that weren't taken")
+	default:
+	}
+}
+
+func TestMailboxMergesPaths(t *testing.T) {
+	box := newMailbox(false)
+
+	box.put(update{value: []byte("1"), paths: [][]string{{"foo"}}})
+	box.put(update{value: []byte("2"), paths: [][]string{{"bar", "baz"}}})
+
+	assert.Equal(t, []update{{value: []byte("2"), paths: [][]string{{"foo"}, {"bar", "baz"}}}}, box.take())
+
+	box.put(update{value: []byte("3"), paths: [][]string{{"foo"}}})
+	box.put(update{value: []byte("4")})
+	box.put(update{value: []byte("5"), paths: [][]string{{"bar"}}})
+
+	assert.Equal(t, []update{{value: []byte("5")}}, box.take())
+}
+
+func TestMailboxMergesOps(t *testing.T) {
+	box := newMailbox(false)
+
+	foo := treeOp{path: []string{"foo"}, data: "1"}
+	bar := treeOp{path: []string{"bar"}, data: "2"}
+
+	box.put(update{value: []byte("{}")})
+	box.put(update{ops: []treeOp{foo}, paths: [][]string{{"foo"}}})
+	box.put(update{ops: []treeOp{bar}, paths: [][]string{{"bar"}}})
+
+	assert.Equal(t, []update{{value: []byte("{}"), ops: []treeOp{foo, bar}}}, box.take())
+
+	box.put(update{ops: []treeOp{foo}, paths: [][]string{{"foo"}}})
+	box.put(update{value: []byte("{}")})
+
+	assert.Equal(t, []update{{value: []byte("{}")}}, box.take())
+}
+
+func TestMailboxMergesSync(t *testing.T) {
+	box := newMailbox(false)
+
+	box.put(update{value: []byte("1"), sync: true})
+	box.put(update{value: []byte("2"), paths: [][]string{{"foo"}}})
+
+	assert.Equal(t, []update{{value: []byte("2"), sync: true}}, box.take())
+}
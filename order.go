@@ -0,0 +1,199 @@
+package firebasehelpers
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type orderBy int
+
+const (
+	byKey orderBy = iota
+	byValue
+	byChild
+)
+
+// Order defines how children of a node are sorted. It follows firebase rules:
+// when ordering by value or child, nulls go first, then false, true, numbers,
+// strings and objects, and children with equal values are sorted by key. Keys
+// that are 32-bit integers go before other keys and are sorted numerically.
+type Order struct {
+	by   orderBy
+	path []string
+}
+
+// OrderByKey sorts children by their keys
+func OrderByKey() Order {
+	return Order{by: byKey}
+}
+
+// OrderByValue sorts children by their values
+func OrderByValue() Order {
+	return Order{by: byValue}
+}
+
+// OrderByChild sorts children by value at given path inside each of them
+func OrderByChild(path ...string) Order {
+	return Order{by: byChild, path: path}
+}
+
+// Returns what child is sorted by, that is its key or decoded value
+func (o Order) sortValue(key string, value []byte) interface{} {
+	switch o.by {
+	case byValue:
+		return decodeValue(value)
+	case byChild:
+		return decodeValue(get(value, o.path...))
+	}
+
+	return key
+}
+
+// Like sortValue, but for child decoded from json
+func (o Order) sortDecoded(key string, value interface{}) interface{} {
+	switch o.by {
+	case byValue:
+		return normalizeValue(value)
+	case byChild:
+		for _, k := range o.path {
+			object, ok := value.(map[string]interface{})
+
+			if !ok {
+				return nil
+			}
+
+			value = object[k]
+		}
+
+		return normalizeValue(value)
+	}
+
+	return key
+}
+
+// Compares children by their keys and sort values
+func (o Order) compare(aKey string, aValue interface{}, bKey string, bValue interface{}) int {
+	if o.by != byKey {
+		if result := compareValues(aValue, bValue); result != 0 {
+			return result
+		}
+	}
+
+	return compareKeys(aKey, bKey)
+}
+
+// Compares sort value with value given by user, like query bound
+func (o Order) compareBound(sortValue interface{}, bound interface{}) int {
+	if o.by == byKey {
+		return compareKeys(sortValue.(string), keyBound(bound))
+	}
+
+	return compareValues(sortValue, normalizeValue(bound))
+}
+
+// Returns bound of query ordered by key as string, as keys are strings and
+// firebase accepts only string bounds for them
+func keyBound(bound interface{}) string {
+	if key, ok := bound.(string); ok {
+		return key
+	}
+
+	return strconv.FormatFloat(toFloat(bound), 'f', -1, 64)
+}
+
+func decodeValue(value []byte) interface{} {
+	var result interface{}
+
+	if value != nil {
+		json.Unmarshal(value, &result)
+	}
+
+	return result
+}
+
+// Converts numbers given by user to float64, as they're decoded from json
+func normalizeValue(value interface{}) interface{} {
+	switch value.(type) {
+	case nil, bool, string, float64, map[string]interface{}, []interface{}:
+		return value
+	case json.Number:
+		f, _ := value.(json.Number).Float64()
+		return f
+	}
+
+	if f := toFloat(value); !math.IsNaN(f) {
+		return f
+	}
+
+	return value
+}
+
+func toFloat(value interface{}) float64 {
+	v := reflect.ValueOf(value)
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+
+	return math.NaN()
+}
+
+func valueRank(value interface{}) int {
+	switch value := value.(type) {
+	case nil:
+		return 0
+	case bool:
+		if value {
+			return 2
+		}
+
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	}
+
+	return 5
+}
+
+func compareValues(a interface{}, b interface{}) int {
+	aRank, bRank := valueRank(a), valueRank(b)
+
+	if aRank != bRank {
+		return compareInts(aRank, bRank)
+	}
+
+	switch a := a.(type) {
+	case float64:
+		b := b.(float64)
+
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+
+	return 0
+}
+
+func compareInts(a int, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,53 @@
+package firebasehelpers
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareKeys(t *testing.T) {
+	keys := []string{"b", "10", "a", "2", "-1", "01", "1"}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+
+	assert.Equal(t, []string{"-1", "1", "2", "10", "01", "a", "b"}, keys)
+}
+
+func TestCompareValues(t *testing.T) {
+	values := []interface{}{
+		map[string]interface{}{},
+		"b",
+		"a",
+		float64(10),
+		float64(2),
+		true,
+		false,
+		nil,
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return compareValues(values[i], values[j]) < 0
+	})
+
+	assert.Equal(t, []interface{}{
+		nil,
+		false,
+		true,
+		float64(2),
+		float64(10),
+		"a",
+		"b",
+		map[string]interface{}{},
+	}, values)
+}
+
+func TestOrderCompareBound(t *testing.T) {
+	assert.Equal(t, 0, OrderByValue().compareBound(float64(10), 10))
+	assert.Equal(t, -1, OrderByValue().compareBound(float64(10), uint8(11)))
+	assert.Equal(t, 1, OrderByKey().compareBound("b", "a"))
+	assert.Equal(t, 0, OrderByKey().compareBound("10", 10))
+}
@@ -1,10 +1,8 @@
 package firebasehelpers
 
-import "strings"
-
-func patch(object interface{}, keys []string, value map[string]interface{}) interface{} {
+func patch(object interface{}, keys []string, value map[string]interface{}, undo *undoLog) interface{} {
 	for key, value := range value {
-		object = put(object, append(keys, key), value)
+		object = put(object, append(keys, key), value, undo)
 	}
 
 	return object
@@ -13,15 +11,24 @@ func patch(object interface{}, keys []string, value map[string]interface{}) inte
 func Patch(object interface{}, path string, value interface{}) interface{} {
 	switch value := value.(type) {
 	case map[string]interface{}:
-		keys := strings.Split(path[1:], "/")
+		return patch(object, splitPath(path), value, nil)
+	}
 
-		// If path is "/" then keys is []string{""}, not []string{}
-		if keys[0] == "" {
-			keys = []string{}
-		}
+	return object
+}
+
+// Returns paths changed by applying Patch with given arguments
+func patchedPaths(path string, value interface{}) [][]string {
+	paths := [][]string{}
 
-		return patch(object, keys, value)
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := splitPath(path)
+
+		for key := range value {
+			paths = append(paths, append(keys[:len(keys):len(keys)], key))
+		}
 	}
 
-	return object
+	return paths
 }
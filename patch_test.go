@@ -34,3 +34,19 @@ func TestPatchShallow(t *testing.T) {
 	source = PatchString(source, "/", `{"fiz":"faz","foo":{"foo":"bar"}}`)
 	assert.Equal(t, target, source)
 }
+
+func TestPatchedPaths(t *testing.T) {
+	var value interface{}
+	json.Unmarshal([]byte(`{"bar":null,"fiz":"fuz"}`), &value)
+
+	assert.ElementsMatch(t, [][]string{{"foo", "bar"}, {"foo", "fiz"}}, patchedPaths("/foo", value))
+	assert.ElementsMatch(t, [][]string{{"bar"}, {"fiz"}}, patchedPaths("/", value))
+	assert.Empty(t, patchedPaths("/foo", "bar"))
+}
+
+func TestPatchArray(t *testing.T) {
+	source := `{"foo":["bar","baz"]}`
+	target := `{"foo":{"1":"baz","2":"buz"}}`
+	source = PatchString(source, "/foo", `{"0":null,"2":"buz"}`)
+	assert.Equal(t, target, source)
+}
@@ -1,6 +1,9 @@
 package firebasehelpers
 
-import "strings"
+import (
+	"strconv"
+	"strings"
+)
 
 func emptyWithValue(keys []string, value interface{}) interface{} {
 	if len(keys) == 0 {
@@ -14,7 +17,9 @@ func emptyWithValue(keys []string, value interface{}) interface{} {
 	return map[string]interface{}{keys[0]: emptyWithValue(keys[1:], value)}
 }
 
-func put(object interface{}, keys []string, value interface{}) interface{} {
+// Puts value at keys changing objects in place, replaced values are recorded
+// in undo log if it's given
+func put(object interface{}, keys []string, value interface{}, undo *undoLog) interface{} {
 	if len(keys) == 0 {
 		return value
 	}
@@ -23,7 +28,8 @@ func put(object interface{}, keys []string, value interface{}) interface{} {
 
 	switch typed := object.(type) {
 	case map[string]interface{}:
-		typed[key] = put(typed[key], keys[1:], value)
+		undo.record(typed, key)
+		typed[key] = put(typed[key], keys[1:], value, undo)
 
 		if typed[key] == nil {
 			delete(typed, key)
@@ -34,12 +40,28 @@ func put(object interface{}, keys []string, value interface{}) interface{} {
 		}
 
 		return object
+	case []interface{}:
+		return put(arrayToMap(typed), keys, value, undo)
 	}
 
 	return emptyWithValue(keys, value)
 }
 
-func Put(object interface{}, path string, value interface{}) interface{} {
+// Converts array sent by firebase for node with integer keys back to object
+func arrayToMap(array []interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+
+	for i, item := range array {
+		if item != nil {
+			result[strconv.Itoa(i)] = item
+		}
+	}
+
+	return result
+}
+
+// Splits firebase path like "/foo/bar" into keys
+func splitPath(path string) []string {
 	keys := strings.Split(path[1:], "/")
 
 	// If path is "/" then keys is []string{""}, not []string{}
@@ -47,5 +69,9 @@ func Put(object interface{}, path string, value interface{}) interface{} {
 		keys = []string{}
 	}
 
-	return put(object, keys, value)
+	return keys
+}
+
+func Put(object interface{}, path string, value interface{}) interface{} {
+	return put(object, splitPath(path), value, nil)
 }
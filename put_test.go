@@ -117,3 +117,11 @@ func TestComplex(t *testing.T) {
 	source = PutString(source, "/fiz", `"fuz"`)
 	assert.Equal(t, target, source)
 }
+
+func TestPutIntoArray(t *testing.T) {
+	source := `{"foo":["bar",null,"baz"]}`
+	target := `{"foo":{"0":"bar","1":"buz","2":"baz"}}`
+	result := PutString(source, "/foo/1", `"buz"`)
+
+	assert.Equal(t, target, result)
+}
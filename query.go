@@ -0,0 +1,512 @@
+package firebasehelpers
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/knq/firebase"
+)
+
+// QueryItem is a child of queried node
+type QueryItem struct {
+	Key   string
+	Value []byte
+
+	sortValue interface{}
+}
+
+type queryBound struct {
+	value interface{}
+	key   *string
+}
+
+// Query is an ordered and optionally limited view of children at cursor path,
+// like firebase queries but evaluated on the client. Queries are immutable,
+// each modifier returns a new one.
+type Query struct {
+	cursor *cursor
+	child  string
+	order  Order
+	start  *queryBound
+	end    *queryBound
+	first  int
+	last   int
+}
+
+// NewQuery returns query that isn't bound to any path, for WatchFirebaseQuery
+func NewQuery(order Order) *Query {
+	return &Query{child: "*", order: order}
+}
+
+// Query returns children of cursor path sorted in given order
+func (c *cursor) Query(order Order) *Query {
+	return &Query{cursor: c, child: "*", order: order}
+}
+
+// OrderByKey returns query with children sorted by keys
+func (c *cursor) OrderByKey() *Query {
+	return c.Query(OrderByKey())
+}
+
+// OrderByValue returns query with children sorted by values
+func (c *cursor) OrderByValue() *Query {
+	return c.Query(OrderByValue())
+}
+
+// OrderByChild returns query with children sorted by value at given path
+func (c *cursor) OrderByChild(path ...string) *Query {
+	return c.Query(OrderByChild(path...))
+}
+
+func newBound(value interface{}, key []string) *queryBound {
+	bound := &queryBound{value: value}
+
+	if len(key) > 0 {
+		bound.key = &key[0]
+	}
+
+	return bound
+}
+
+// StartAt limits children to ones sorted at or after value, and if key is
+// given, children equal to value must have key at or after it
+func (q *Query) StartAt(value interface{}, key ...string) *Query {
+	result := *q
+	result.start = newBound(value, key)
+	return &result
+}
+
+// EndAt limits children to ones sorted at or before value, and if key is
+// given, children equal to value must have key at or before it
+func (q *Query) EndAt(value interface{}, key ...string) *Query {
+	result := *q
+	result.end = newBound(value, key)
+	return &result
+}
+
+// EqualTo limits children to ones equal to value
+func (q *Query) EqualTo(value interface{}, key ...string) *Query {
+	return q.StartAt(value, key...).EndAt(value, key...)
+}
+
+// LimitToFirst limits children to first n of them
+func (q *Query) LimitToFirst(n int) *Query {
+	result := *q
+	result.first = n
+	result.last = 0
+	return &result
+}
+
+// LimitToLast limits children to last n of them
+func (q *Query) LimitToLast(n int) *Query {
+	result := *q
+	result.last = n
+	result.first = 0
+	return &result
+}
+
+func (q *Query) inBounds(item QueryItem) bool {
+	if q.start != nil {
+		result := q.order.compareBound(item.sortValue, q.start.value)
+
+		if result < 0 || result == 0 && q.start.key != nil && compareKeys(item.Key, *q.start.key) < 0 {
+			return false
+		}
+	}
+
+	if q.end != nil {
+		result := q.order.compareBound(item.sortValue, q.end.value)
+
+		if result > 0 || result == 0 && q.end.key != nil && compareKeys(item.Key, *q.end.key) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns children of value that match the query in query order
+func (q *Query) items(value []byte) []QueryItem {
+	items := []QueryItem{}
+
+	eachChild(value, func(key string, child []byte) {
+		if isWildcard(q.child) || q.child == key {
+			items = append(items, QueryItem{Key: key, Value: child, sortValue: q.order.sortValue(key, child)})
+		}
+	})
+
+	return q.window(items)
+}
+
+// Filters, sorts and limits items
+func (q *Query) window(all []QueryItem) []QueryItem {
+	items := []QueryItem{}
+
+	for _, item := range all {
+		if q.inBounds(item) {
+			items = append(items, item)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return q.less(items[i], items[j])
+	})
+
+	return q.limit(items)
+}
+
+// Returns true if item a goes before item b in query order
+func (q *Query) less(a QueryItem, b QueryItem) bool {
+	return q.order.compare(a.Key, a.sortValue, b.Key, b.sortValue) < 0
+}
+
+// Returns sorted items left after limits
+func (q *Query) limit(items []QueryItem) []QueryItem {
+	if q.first > 0 && len(items) > q.first {
+		return items[:q.first]
+	}
+
+	if q.last > 0 && len(items) > q.last {
+		return items[len(items)-q.last:]
+	}
+
+	return items
+}
+
+// Removes children of decoded tree that don't match the query, and returns
+// new tree with paths of removed children. Removed values are recorded in undo
+// log if it's given.
+func (q *Query) prune(tree interface{}, undo *undoLog) (interface{}, [][]string) {
+	if array, ok := tree.([]interface{}); ok {
+		tree = arrayToMap(array)
+	}
+
+	object, ok := tree.(map[string]interface{})
+
+	if !ok {
+		return tree, nil
+	}
+
+	items := []QueryItem{}
+
+	for key, value := range object {
+		items = append(items, QueryItem{Key: key, sortValue: q.order.sortDecoded(key, value)})
+	}
+
+	keep := map[string]struct{}{}
+
+	for _, item := range q.window(items) {
+		keep[item.Key] = struct{}{}
+	}
+
+	pruned := [][]string{}
+
+	for key := range object {
+		if _, ok := keep[key]; !ok {
+			undo.record(object, key)
+			delete(object, key)
+			pruned = append(pruned, []string{key})
+		}
+	}
+
+	if len(object) == 0 {
+		return nil, pruned
+	}
+
+	return object, pruned
+}
+
+// Returns options sending the query to firebase. Keys of bounds aren't
+// supported by firebase REST API, so they're only applied by prune.
+func (q *Query) firebaseOptions() []firebase.QueryOption {
+	params := url.Values{}
+
+	encode := func(value interface{}) string {
+		result, _ := json.Marshal(value)
+		return string(result)
+	}
+
+	switch q.order.by {
+	case byKey:
+		params.Set("orderBy", encode("$key"))
+	case byValue:
+		params.Set("orderBy", encode("$value"))
+	case byChild:
+		params.Set("orderBy", encode(strings.Join(q.order.path, "/")))
+	}
+
+	bound := func(value interface{}) string {
+		if q.order.by == byKey {
+			return encode(keyBound(value))
+		}
+
+		return encode(value)
+	}
+
+	if q.start != nil {
+		params.Set("startAt", bound(q.start.value))
+	}
+
+	if q.end != nil {
+		params.Set("endAt", bound(q.end.value))
+	}
+
+	if q.first > 0 {
+		params.Set("limitToFirst", strconv.Itoa(q.first))
+	}
+
+	if q.last > 0 {
+		params.Set("limitToLast", strconv.Itoa(q.last))
+	}
+
+	return []firebase.QueryOption{func(v url.Values) error {
+		for key, values := range params {
+			v[key] = values
+		}
+
+		return nil
+	}}
+}
+
+// Items returns current children matching the query
+func (q *Query) Items() []QueryItem {
+	return q.items(q.cursor.Value())
+}
+
+// Listen calls cb when children enter the query (Added), leave it (Removed),
+// change their value (Changed), or change their position because of it (Moved).
+// Sorted children are kept between events, so a change costs as much as the
+// changed children, not the whole queried node.
+func (q *Query) Listen(cb func(Event)) *Listener {
+	children := q.cursor.Select(q.child)
+	sorted := map[string][]QueryItem{}
+
+	return q.cursor.stream.add(&Listener{cursor: children, batch: func(events []Event) {
+		for _, group := range groupByParent(events) {
+			parent := group[0].Path[:len(group[0].Path)-1]
+			key := strings.Join(parent, "/")
+
+			prev := sorted[key]
+			curr, changes := q.update(prev, group)
+			diff := queryDiff{query: q, prev: q.limit(prev), curr: q.limit(curr), changes: changes}
+
+			for _, e := range diff.events() {
+				e.Path = append(parent[:len(parent):len(parent)], e.Path...)
+				e.Bindings = bindings(children.path, e.Path)
+				e.Revision = group[0].Revision
+				cb(e)
+			}
+
+			if len(curr) == 0 {
+				delete(sorted, key)
+			} else {
+				sorted[key] = curr
+			}
+		}
+	}})
+}
+
+// Splits events of children into groups of siblings, in order of their first
+// events
+func groupByParent(events []Event) [][]Event {
+	groups := [][]Event{}
+	index := map[string]int{}
+
+	for _, event := range events {
+		key := strings.Join(event.Path[:len(event.Path)-1], "/")
+		i, ok := index[key]
+
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+
+		groups[i] = append(groups[i], event)
+	}
+
+	return groups
+}
+
+// Change of a child of queried node, items are nil if the child is missing or
+// out of bounds
+type queryChange struct {
+	prev *QueryItem
+	curr *QueryItem
+}
+
+// Applies events of children to items sorted in query order, and returns new
+// sorted items along with changes by key
+func (q *Query) update(items []QueryItem, events []Event) ([]QueryItem, map[string]queryChange) {
+	changes := map[string]queryChange{}
+	added := []QueryItem{}
+
+	for _, event := range events {
+		key := event.Path[len(event.Path)-1]
+		change := queryChange{}
+
+		if event.Prev != nil {
+			change.prev = &QueryItem{Key: key, Value: event.Prev, sortValue: q.order.sortValue(key, event.Prev)}
+		}
+
+		if event.Curr != nil {
+			item := QueryItem{Key: key, Value: event.Curr, sortValue: q.order.sortValue(key, event.Curr)}
+
+			if q.inBounds(item) {
+				change.curr = &item
+				added = append(added, item)
+			}
+		}
+
+		changes[key] = change
+	}
+
+	sort.SliceStable(added, func(i, j int) bool {
+		return q.less(added[i], added[j])
+	})
+
+	result := make([]QueryItem, 0, len(items)+len(added))
+
+	for _, item := range items {
+		if _, ok := changes[item.Key]; ok {
+			continue
+		}
+
+		for len(added) > 0 && q.less(added[0], item) {
+			result = append(result, added[0])
+			added = added[1:]
+		}
+
+		result = append(result, item)
+	}
+
+	return append(result, added...), changes
+}
+
+// Windows of sorted children before and after a change
+type queryDiff struct {
+	query   *Query
+	prev    []QueryItem
+	curr    []QueryItem
+	changes map[string]queryChange
+}
+
+// Returns position of item in window, or -1 if it's missing
+func (d queryDiff) find(window []QueryItem, item *QueryItem) int {
+	if item == nil {
+		return -1
+	}
+
+	i := sort.Search(len(window), func(i int) bool {
+		return !d.query.less(window[i], *item)
+	})
+
+	if i < len(window) && window[i].Key == item.Key {
+		return i
+	}
+
+	return -1
+}
+
+// Returns positions of child in previous and current window, or -1 where
+// it's missing
+func (d queryDiff) positions(item QueryItem) (int, int) {
+	prev, curr := &item, &item
+
+	if change, ok := d.changes[item.Key]; ok {
+		prev, curr = change.prev, change.curr
+	}
+
+	return d.find(d.prev, prev), d.find(d.curr, curr)
+}
+
+// Returns key of the closest child before position i of window that is in
+// both windows, or empty string if there's none
+func (d queryDiff) before(window []QueryItem, i int) string {
+	for i--; i >= 0; i-- {
+		if prev, curr := d.positions(window[i]); prev >= 0 && curr >= 0 {
+			return window[i].Key
+		}
+	}
+
+	return ""
+}
+
+// Returns positions of children of window that could enter or leave it. Only
+// changed children can do so, unless the window is limited.
+func (d queryDiff) candidates(window []QueryItem, item func(queryChange) *QueryItem) []int {
+	result := []int{}
+
+	if d.query.first > 0 || d.query.last > 0 {
+		for i := range window {
+			result = append(result, i)
+		}
+
+		return result
+	}
+
+	for _, change := range d.changes {
+		if i := d.find(window, item(change)); i >= 0 {
+			result = append(result, i)
+		}
+	}
+
+	sort.Ints(result)
+
+	return result
+}
+
+// Returns events that turn previous window into current one, with paths set
+// to keys
+func (d queryDiff) events() []Event {
+	events := []Event{}
+
+	removed := d.candidates(d.prev, func(change queryChange) *QueryItem {
+		return change.prev
+	})
+
+	for j := len(removed) - 1; j >= 0; j-- {
+		item := d.prev[removed[j]]
+
+		if _, curr := d.positions(item); curr < 0 {
+			events = append(events, Event{Kind: Removed, Path: []string{item.Key}, Prev: item.Value})
+		}
+	}
+
+	changed := d.candidates(d.curr, func(change queryChange) *QueryItem {
+		return change.curr
+	})
+
+	for _, i := range changed {
+		item := d.curr[i]
+		prevKey := ""
+
+		if i > 0 {
+			prevKey = d.curr[i-1].Key
+		}
+
+		prev, _ := d.positions(item)
+
+		if prev < 0 {
+			events = append(events, Event{Kind: Added, Path: []string{item.Key}, Curr: item.Value, PrevKey: prevKey})
+			continue
+		}
+
+		prevItem := d.prev[prev]
+
+		if string(prevItem.Value) == string(item.Value) {
+			continue
+		}
+
+		events = append(events, Event{Kind: Changed, Path: []string{item.Key}, Prev: prevItem.Value, Curr: item.Value, PrevKey: prevKey})
+
+		if d.before(d.prev, prev) != d.before(d.curr, i) {
+			events = append(events, Event{Kind: Moved, Path: []string{item.Key}, Prev: prevItem.Value, Curr: item.Value, PrevKey: prevKey})
+		}
+	}
+
+	return events
+}
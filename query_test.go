@@ -0,0 +1,253 @@
+package firebasehelpers
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func itemKeys(items []QueryItem) []string {
+	keys := []string{}
+
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+
+	return keys
+}
+
+func TestQueryItems(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+	defer stream.Shutdown()
+
+	players := stream.Select("players")
+
+	value := []byte(`{"players":{"foo":{"score":10},"bar":{"score":30},"baz":{"score":20},"fiz":{"score":20},"fuz":{}}}`)
+
+	byScore := players.OrderByChild("score")
+
+	assert.Equal(t, []string{"fuz", "foo", "baz", "fiz", "bar"}, itemKeys(byScore.items(get(value, "players"))))
+	assert.Equal(t, []string{"fiz", "bar"}, itemKeys(byScore.LimitToLast(2).items(get(value, "players"))))
+	assert.Equal(t, []string{"fuz", "foo"}, itemKeys(byScore.LimitToFirst(2).items(get(value, "players"))))
+	assert.Equal(t, []string{"baz", "fiz", "bar"}, itemKeys(byScore.StartAt(15).items(get(value, "players"))))
+	assert.Equal(t, []string{"fiz", "bar"}, itemKeys(byScore.StartAt(20, "fiz").items(get(value, "players"))))
+	assert.Equal(t, []string{"fuz", "foo", "baz"}, itemKeys(byScore.EndAt(20, "baz").items(get(value, "players"))))
+	assert.Equal(t, []string{"baz", "fiz"}, itemKeys(byScore.EqualTo(20).items(get(value, "players"))))
+	assert.Equal(t, []string{"baz", "fiz", "foo"}, itemKeys(players.OrderByKey().StartAt("baz").LimitToFirst(3).items(get(value, "players"))))
+}
+
+func TestQueryListen(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	events := make(chan Event, 10)
+
+	stream.Select("players").OrderByChild("score").LimitToLast(2).Listen(func(event Event) {
+		events <- Event{Kind: event.Kind, Path: event.Path}
+	})
+
+	stream.Push([]byte(`{"players":{"foo":{"score":10},"bar":{"score":30},"baz":{"score":20}}}`))
+	stream.Push([]byte(`{"players":{"foo":{"score":40},"bar":{"score":30},"baz":{"score":20}}}`))
+	stream.Push([]byte(`{"players":{"foo":{"score":40},"bar":{"score":50},"baz":{"score":20}}}`))
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"players", "baz"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"players", "bar"}}, <-events)
+
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"players", "baz"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"players", "foo"}}, <-events)
+
+	assert.Equal(t, Event{Kind: Changed, Path: []string{"players", "bar"}}, <-events)
+	assert.Equal(t, Event{Kind: Moved, Path: []string{"players", "bar"}}, <-events)
+}
+
+func TestQueryUpdate(t *testing.T) {
+	query := NewQuery(OrderByValue()).EndAt(10)
+
+	items, _ := query.update(nil, []Event{
+		{Kind: Added, Path: []string{"a"}, Curr: []byte(`3`)},
+		{Kind: Added, Path: []string{"b"}, Curr: []byte(`1`)},
+		{Kind: Added, Path: []string{"c"}, Curr: []byte(`2`)},
+		{Kind: Added, Path: []string{"d"}, Curr: []byte(`20`)},
+	})
+
+	assert.Equal(t, []string{"b", "c", "a"}, itemKeys(items))
+
+	// Only changed children are sorted again
+	items, changes := query.update(items, []Event{
+		{Kind: Removed, Path: []string{"c"}, Prev: []byte(`2`)},
+		{Kind: Changed, Path: []string{"b"}, Prev: []byte(`1`), Curr: []byte(`4`)},
+		{Kind: Changed, Path: []string{"d"}, Prev: []byte(`20`), Curr: []byte(`0`)},
+	})
+
+	assert.Equal(t, []string{"d", "a", "b"}, itemKeys(items))
+	assert.Len(t, changes, 3)
+	assert.Nil(t, changes["c"].curr)
+	assert.Equal(t, []byte(`4`), changes["b"].curr.Value)
+}
+
+func TestQueryListenRoot(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	events := make(chan Event, 10)
+
+	stream.Select().OrderByValue().LimitToFirst(2).Listen(func(event Event) {
+		events <- Event{Kind: event.Kind, Path: event.Path, PrevKey: event.PrevKey}
+	})
+
+	stream.Push([]byte(`{"a":3,"b":1,"c":2}`))
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"b"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"c"}, PrevKey: "b"}, <-events)
+
+	stream.PushChange([]byte(`{"a":0,"b":1,"c":2}`), []string{"a"})
+
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"c"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"a"}}, <-events)
+
+	// Child that hasn't changed enters the query when another one leaves it
+	stream.PushChange([]byte(`{"a":5,"b":1,"c":2}`), []string{"a"})
+
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"a"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"c"}, PrevKey: "b"}, <-events)
+
+	stream.Close()
+
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"c"}}, <-events)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"b"}}, <-events)
+}
+
+func TestListenOrdered(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	events := make(chan Event, 10)
+
+	_, err := stream.ListenOrdered([]string{"teams", "$team", "players", "$player"}, OrderByValue(), func(event Event) {
+		events <- Event{Kind: event.Kind, Path: event.Path, PrevKey: event.PrevKey, Bindings: event.Bindings}
+	})
+
+	assert.NoError(t, err)
+
+	stream.Push([]byte(`{"teams":{"red":{"players":{"foo":2,"bar":1}}}}`))
+	stream.Push([]byte(`{"teams":{"red":{"players":{"foo":2,"bar":3}}}}`))
+
+	assert.Equal(t, Event{
+		Kind:     Added,
+		Path:     []string{"teams", "red", "players", "bar"},
+		Bindings: map[string]string{"team": "red", "player": "bar"},
+	}, <-events)
+
+	assert.Equal(t, Event{
+		Kind:     Added,
+		Path:     []string{"teams", "red", "players", "foo"},
+		Bindings: map[string]string{"team": "red", "player": "foo"},
+		PrevKey:  "bar",
+	}, <-events)
+
+	assert.Equal(t, Event{
+		Kind:     Changed,
+		Path:     []string{"teams", "red", "players", "bar"},
+		Bindings: map[string]string{"team": "red", "player": "bar"},
+		PrevKey:  "foo",
+	}, <-events)
+
+	assert.Equal(t, Event{
+		Kind:     Moved,
+		Path:     []string{"teams", "red", "players", "bar"},
+		Bindings: map[string]string{"team": "red", "player": "bar"},
+		PrevKey:  "foo",
+	}, <-events)
+}
+
+func TestListenOrderedRoot(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	events := make(chan Event, 10)
+
+	_, err := stream.ListenOrdered([]string{"$player"}, OrderByValue(), func(event Event) {
+		events <- Event{Kind: event.Kind, Path: event.Path, PrevKey: event.PrevKey, Bindings: event.Bindings}
+	})
+
+	assert.NoError(t, err)
+
+	stream.Push([]byte(`{"foo":2,"bar":1}`))
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"bar"}, Bindings: map[string]string{"player": "bar"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"foo"}, Bindings: map[string]string{"player": "foo"}, PrevKey: "bar"}, <-events)
+
+	stream.Close()
+}
+
+func TestListenOrderedRejectsInvalidPattern(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{})
+
+	_, err := stream.ListenOrdered([]string{"teams", "**"}, OrderByKey(), func(event Event) {})
+	assert.EqualError(t, err, `ListenOrdered pattern can't end with "**"`)
+
+	_, err = stream.ListenOrdered([]string{}, OrderByKey(), func(event Event) {})
+	assert.EqualError(t, err, "ListenOrdered pattern can't be empty")
+
+	stream.Close()
+}
+
+func TestQueryPrune(t *testing.T) {
+	var tree interface{}
+	json.Unmarshal([]byte(`{"foo":{"score":10},"bar":{"score":30},"baz":{"score":20}}`), &tree)
+
+	tree, pruned := NewQuery(OrderByChild("score")).LimitToLast(2).prune(tree, nil)
+
+	result, _ := json.Marshal(tree)
+
+	assert.Equal(t, `{"bar":{"score":30},"baz":{"score":20}}`, string(result))
+	assert.Equal(t, [][]string{{"foo"}}, pruned)
+}
+
+func TestQueryFirebaseOptions(t *testing.T) {
+	values := url.Values{}
+
+	for _, opt := range NewQuery(OrderByChild("stats", "score")).StartAt(10).EndAt("z").LimitToFirst(5).firebaseOptions() {
+		opt(values)
+	}
+
+	assert.Equal(t, url.Values{
+		"orderBy":      {`"stats/score"`},
+		"startAt":      {`10`},
+		"endAt":        {`"z"`},
+		"limitToFirst": {`5`},
+	}, values)
+
+	values = url.Values{}
+
+	for _, opt := range NewQuery(OrderByKey()).LimitToLast(3).firebaseOptions() {
+		opt(values)
+	}
+
+	assert.Equal(t, url.Values{
+		"orderBy":     {`"$key"`},
+		"limitToLast": {`3`},
+	}, values)
+
+	// Keys are strings, so numeric bounds are sent as strings too
+	values = url.Values{}
+
+	for _, opt := range NewQuery(OrderByKey()).StartAt(10).EndAt(20.5).firebaseOptions() {
+		opt(values)
+	}
+
+	assert.Equal(t, url.Values{
+		"orderBy": {`"$key"`},
+		"startAt": {`"10"`},
+		"endAt":   {`"20.5"`},
+	}, values)
+}
@@ -0,0 +1,126 @@
+package firebasehelpers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Scope holds listeners bound to a path matched by ListenScoped. They are
+// removed when the path is removed or the scoped listener is shut down.
+type Scope struct {
+	// Path is the matched path, patterns of scope's listeners are relative to it
+	Path      []string
+	stream    *Stream
+	listeners []*Listener
+	disposed  bool
+	mux       sync.Mutex
+}
+
+// ListenScoped is like ListenEvents, but callback also receives scope of the
+// matched path. Listeners created with the scope are registered once the
+// callback returns and are removed together with the path.
+func (c *Stream) ListenScoped(pattern []string, cb func(scope *Scope, event Event)) *Listener {
+	return c.add(scoped(c.Select(pattern...), cb))
+}
+
+func scoped(cursor *cursor, cb func(scope *Scope, event Event)) *Listener {
+	listener := &Listener{cursor: cursor, scopes: map[string]*Scope{}}
+
+	listener.cb = func(event Event) {
+		key := strings.Join(event.Path, "/")
+		scope := listener.scopes[key]
+
+		if scope == nil {
+			scope = &Scope{Path: event.Path, stream: cursor.stream}
+			listener.scopes[key] = scope
+		}
+
+		if event.Kind == Removed {
+			delete(listener.scopes, key)
+			defer scope.dispose()
+		}
+
+		cb(scope, event)
+	}
+
+	return listener
+}
+
+// Select returns cursor for path relative to the scope
+func (s *Scope) Select(path ...string) *cursor {
+	return s.stream.Select(append(s.Path[:len(s.Path):len(s.Path)], path...)...)
+}
+
+// Listen is like Stream.Listen, but pattern is relative to the scope
+func (s *Scope) Listen(pattern []string, cb func(path []string, prev []byte, curr []byte)) *Listener {
+	return s.ListenEvents(pattern, func(event Event) {
+		cb(event.Path, event.Prev, event.Curr)
+	})
+}
+
+// ListenEvents is like Stream.ListenEvents, but pattern is relative to the scope
+func (s *Scope) ListenEvents(pattern []string, cb func(Event)) *Listener {
+	return s.add(&Listener{cursor: s.Select(pattern...), cb: cb})
+}
+
+// ListenScoped is like Stream.ListenScoped, but pattern is relative to the
+// scope. Nested scopes are disposed together with this one.
+func (s *Scope) ListenScoped(pattern []string, cb func(scope *Scope, event Event)) *Listener {
+	return s.add(scoped(s.Select(pattern...), cb))
+}
+
+func (s *Scope) add(listener *Listener) *Listener {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// Listener of removed path would never be removed
+	if s.disposed {
+		listener.stop()
+		return listener
+	}
+
+	s.listeners = append(s.listeners, listener)
+
+	// Scope is usually used in callbacks, which can't wait for processMux
+	return s.stream.addLater(listener)
+}
+
+// Removes listeners of the scope. It must be called with processMux of scope's
+// stream held.
+func (s *Scope) dispose() {
+	s.mux.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.disposed = true
+	s.mux.Unlock()
+
+	for i := len(listeners) - 1; i >= 0; i-- {
+		// Listener of synthetic path is removed by its own stream, as only
+		// processMux of this one is held
+		if listeners[i].cursor.stream != s.stream {
+			listeners[i].cursor.stream.removeLater(listeners[i])
+			continue
+		}
+
+		s.stream.unlisten(listeners[i])
+	}
+}
+
+// Disposes scopes left after listener is removed. It must be called with
+// processMux held.
+func (w *Listener) disposeScopes() {
+	keys := make([]string, 0, len(w.scopes))
+
+	for key := range w.scopes {
+		keys = append(keys, key)
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	for _, key := range keys {
+		scope := w.scopes[key]
+		delete(w.scopes, key)
+		scope.dispose()
+	}
+}
@@ -0,0 +1,122 @@
+package firebasehelpers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenScoped(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	events := make(chan string, 20)
+
+	stream.ListenScoped([]string{"managers", "*"}, func(scope *Scope, event Event) {
+		events <- event.Kind.String() + " " + strings.Join(event.Path, "/")
+
+		if event.Kind == Added {
+			scope.Listen([]string{"supervisors", "*"}, func(path []string, prev []byte, curr []byte) {
+				events <- "supervisor " + strings.Join(path, "/") + " " + string(curr)
+			})
+		}
+	})
+
+	stream.Push([]byte(`{"managers":{"foo":{"supervisors":{"fiz":1}}}}`))
+
+	assert.Equal(t, "added managers/foo", <-events)
+	assert.Equal(t, "supervisor managers/foo/supervisors/fiz 1", <-events)
+
+	stream.Push([]byte(`{"managers":{"foo":{"supervisors":{"fiz":2}},"bar":{"supervisors":{"fuz":1}}}}`))
+
+	// Paths are passed in key order
+	assert.Equal(t, "added managers/bar", <-events)
+	assert.Equal(t, "changed managers/foo", <-events)
+	assert.Equal(t, "supervisor managers/foo/supervisors/fiz 2", <-events)
+	assert.Equal(t, "supervisor managers/bar/supervisors/fuz 1", <-events)
+
+	stream.Push([]byte(`{"managers":{"bar":{"supervisors":{"fuz":1}}}}`))
+
+	// Child listeners are notified first and removed with the path
+	assert.Equal(t, "supervisor managers/foo/supervisors/fiz ", <-events)
+	assert.Equal(t, "removed managers/foo", <-events)
+
+	stream.Push([]byte(`{"managers":{"foo":{"supervisors":{"fiz":3}},"bar":{"supervisors":{"fuz":1}}}}`))
+
+	assert.Equal(t, "added managers/foo", <-events)
+	assert.Equal(t, "supervisor managers/foo/supervisors/fiz 3", <-events)
+
+	stream.processMux.Lock()
+	assert.Len(t, stream.listeners, 3)
+	stream.processMux.Unlock()
+
+	stream.Close()
+
+	assert.Empty(t, stream.listeners)
+}
+
+func TestListenScopedShutdown(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	events := make(chan string, 20)
+
+	listener := stream.ListenScoped([]string{"managers", "*"}, func(scope *Scope, event Event) {
+		if event.Kind != Added {
+			return
+		}
+
+		scope.ListenScoped([]string{"supervisors", "*"}, func(scope *Scope, event Event) {
+			if event.Kind == Added {
+				scope.Listen([]string{"name"}, func(path []string, prev []byte, curr []byte) {
+					events <- strings.Join(path, "/") + " " + string(curr)
+				})
+			}
+		})
+	})
+
+	stream.Push([]byte(`{"managers":{"foo":{"supervisors":{"fiz":{"name":"Fiz"}}}}}`))
+
+	assert.Equal(t, `managers/foo/supervisors/fiz/name "Fiz"`, <-events)
+
+	// Ending the parent listener removes nested listeners of all its scopes
+	listener.shutdown()
+
+	assert.Equal(t, "managers/foo/supervisors/fiz/name ", <-events)
+
+	stream.processMux.Lock()
+	assert.Empty(t, stream.listeners)
+	stream.processMux.Unlock()
+}
+
+func TestScopeDisposesListenerOfSyntheticPath(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{})
+	defer stream.Shutdown()
+
+	events := make(chan Event, 10)
+
+	scope := &Scope{stream: stream}
+	scope.add(&Listener{cursor: stream.Select(".info", "connected"), cb: func(event Event) {
+		events <- event
+	}})
+
+	assert.Equal(t, Added, (<-events).Kind)
+
+	// Listener belongs to the info stream, which removes it by itself
+	stream.processMux.Lock()
+	scope.dispose()
+	stream.processMux.Unlock()
+
+	assert.Equal(t, Removed, (<-events).Kind)
+
+	stream.info.processMux.Lock()
+	assert.Empty(t, stream.info.listeners)
+	stream.info.processMux.Unlock()
+}
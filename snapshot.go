@@ -0,0 +1,98 @@
+package firebasehelpers
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Snapshot is an immutable value of the stream at some path and revision
+type Snapshot struct {
+	path     []string
+	value    []byte
+	revision uint64
+}
+
+// Key returns last key of snapshot's path, or empty string for root
+func (s Snapshot) Key() string {
+	if len(s.path) == 0 {
+		return ""
+	}
+
+	return s.path[len(s.path)-1]
+}
+
+// Path returns path of the snapshot
+func (s Snapshot) Path() []string {
+	return append([]string{}, s.path...)
+}
+
+// Revision returns number of values processed by the stream before the snapshot
+func (s Snapshot) Revision() uint64 {
+	return s.revision
+}
+
+// Exists returns true if there is value at snapshot's path
+func (s Snapshot) Exists() bool {
+	return s.value != nil
+}
+
+// Child returns snapshot of value at path relative to this one
+func (s Snapshot) Child(path ...string) Snapshot {
+	return Snapshot{
+		path:     append(s.path[:len(s.path):len(s.path)], path...),
+		value:    get(s.value, path...),
+		revision: s.revision,
+	}
+}
+
+// NumChildren returns number of children of object or array value
+func (s Snapshot) NumChildren() int {
+	count := 0
+
+	eachChild(s.value, func(key string, value []byte) {
+		count++
+	})
+
+	return count
+}
+
+// ForEach calls fn for each child in key order until it returns false
+func (s Snapshot) ForEach(fn func(child Snapshot) bool) {
+	children := []Snapshot{}
+
+	eachChild(s.value, func(key string, value []byte) {
+		children = append(children, Snapshot{
+			path:     append(s.path[:len(s.path):len(s.path)], key),
+			value:    value,
+			revision: s.revision,
+		})
+	})
+
+	sort.SliceStable(children, func(i, j int) bool {
+		return compareKeys(children[i].Key(), children[j].Key()) < 0
+	})
+
+	for _, child := range children {
+		if !fn(child) {
+			return
+		}
+	}
+}
+
+// Decode unmarshals value into v, missing value is decoded as null
+func (s Snapshot) Decode(v interface{}) error {
+	if s.value == nil {
+		return json.Unmarshal([]byte("null"), v)
+	}
+
+	return json.Unmarshal(s.value, v)
+}
+
+// Raw returns copy of json value, or nil if it doesn't exist
+func (s Snapshot) Raw() []byte {
+	if s.value == nil {
+		return nil
+	}
+
+	return append([]byte{}, s.value...)
+}
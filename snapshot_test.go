@@ -0,0 +1,63 @@
+package firebasehelpers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	snapshot := Snapshot{value: []byte(`{"managers":{"foo":{"name":"Foo"},"10":{"name":"Ten"},"2":{"name":"Two"}}}`), revision: 3}
+
+	managers := snapshot.Child("managers")
+
+	assert.Equal(t, "managers", managers.Key())
+	assert.True(t, managers.Exists())
+	assert.Equal(t, 3, managers.NumChildren())
+	assert.Equal(t, uint64(3), managers.Revision())
+
+	keys := []string{}
+
+	managers.ForEach(func(child Snapshot) bool {
+		keys = append(keys, child.Key())
+		return child.Key() != "10"
+	})
+
+	assert.Equal(t, []string{"2", "10"}, keys)
+
+	var name string
+	assert.Nil(t, managers.Child("foo", "name").Decode(&name))
+	assert.Equal(t, "Foo", name)
+	assert.Equal(t, []string{"managers", "foo", "name"}, managers.Child("foo", "name").Path())
+
+	missing := snapshot.Child("managers", "bar")
+	assert.False(t, missing.Exists())
+	assert.Equal(t, 0, missing.NumChildren())
+	assert.Nil(t, missing.Raw())
+
+	var value map[string]interface{}
+	assert.Nil(t, missing.Decode(&value))
+	assert.Nil(t, value)
+}
+
+func TestStreamSnapshot(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{})
+	defer stream.Shutdown()
+
+	assert.False(t, stream.Snapshot().Exists())
+
+	received := make(chan Snapshot, 1)
+
+	stream.Listen([]string{"foo"}, func(path []string, prev []byte, curr []byte) {
+		received <- stream.Select("foo").Snapshot()
+	})
+
+	stream.Push([]byte(`{"foo":"bar"}`))
+
+	snapshot := <-received
+
+	assert.Equal(t, []byte(`"bar"`), snapshot.Raw())
+	assert.Equal(t, uint64(1), snapshot.Revision())
+	assert.Equal(t, []byte(`"bar"`), stream.Select("foo").Value())
+}
@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	j "github.com/bitly/go-simplejson"
@@ -16,71 +17,264 @@ import (
 	"github.com/desertbit/timer"
 	"github.com/knq/firebase"
 	"github.com/pkg/errors"
-	"github.com/radovskyb/watcher"
 	"github.com/sheerun/yson"
 )
 
-type event struct {
-	Path []string
-	Prev []byte
-	Curr []byte
-}
+// ErrStreamClosed is returned when pushing to a stream that has been shut down
+var ErrStreamClosed = errors.New("stream is closed")
 
 type Stream struct {
-	errHandler   func(error)
-	value        []byte
-	in           chan []byte
-	ShutdownChan chan struct{}
-	stop         chan struct{}
-	stopped      bool
-	listeners    []*Listener
-	mux          sync.Mutex
-	processMux   sync.Mutex
-	shutdownMux  sync.Mutex
-	wg           sync.WaitGroup
+	ctx           context.Context
+	cancel        context.CancelFunc
+	errHandler    func(error)
+	errs          chan error
+	maxPanics     int
+	droppedErrors uint64
+	droppedEvents uint64
+	tree          interface{}
+	treeMux       sync.RWMutex
+	ready         chan struct{}
+	readyOnce     sync.Once
+	synced        int32
+	unsync        bool
+	box           *mailbox
+	refreshChan   chan struct{}
+	ShutdownChan  chan struct{}
+	listeners     []*Listener
+	added         []*Listener
+	detached      []*Listener
+	removing      []*Listener
+	addedMux      sync.Mutex
+	unsynced      []*Listener
+	index         *patternIndex
+	nextID        uint64
+	revision      uint64
+	processMux    sync.Mutex
+	teardownMux   sync.Mutex
+	teardownErrs  []error
+	wg            sync.WaitGroup
+
+	// Synthetic ".info" tree describing connection is kept in its own stream
+	info          *Stream
+	connection    ConnectionState
+	connectionMux sync.Mutex
+}
+
+// StreamOptions configures a Stream created with NewStreamContext
+type StreamOptions struct {
+	// ErrHandler receives errors that happen while the stream is running.
+	// Errors are logged if it's not set.
+	ErrHandler func(error)
+
+	// UnsyncOnReconnect makes IsSynced return false after connection to
+	// firebase is lost, until initial data is loaded again
+	UnsyncOnReconnect bool
+
+	// MaxPanics removes listener after its callback panics that many times.
+	// Panics are recovered and reported to ErrHandler in any case. Zero
+	// means listeners are never removed.
+	MaxPanics int
+
+	// ErrorBuffer is how many errors can wait for ErrHandler before next ones
+	// are dropped, 64 by default
+	ErrorBuffer int
+
+	// Strict makes the stream process every pushed value in order. By default
+	// values pushed while listeners are busy are coalesced and only the latest
+	// one is processed. In strict mode pending values are queued without limit.
+	Strict bool
+}
+
+type teardownError []error
+
+func (e teardownError) Error() string {
+	msgs := make([]string, len(e))
+
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return "stream teardown failed: " + strings.Join(msgs, "; ")
 }
 
 type Listener struct {
+	id     uint64
 	cursor *cursor
-	value  []byte
-	cb     func(path []string, prev []byte, curr []byte)
-	mux    sync.Mutex
-}
-
-func matches(json []byte, pattern []string) [][]string {
-	keys := []string{}
-
-	if len(pattern) > 0 {
-		if pattern[0] == "*" {
-			yson.EachKey(json, func(key []byte) {
-				keys = append(keys, string(key))
-			})
-		} else {
-			if yson.Get(json, pattern[0]) != nil {
-				keys = append(keys, string(pattern[0]))
-			}
+	synced bool
+	panics int
+	// removed is set when listener is removed while its callbacks are called
+	removed bool
+	// batch receives events in pending after each processed value
+	batch   func([]Event)
+	pending []Event
+	// scopes of listeners created with ListenScoped by matched path
+	scopes map[string]*Scope
+	// stopped is closed when async listener is removed, nil for other ones
+	stopped  chan struct{}
+	stopOnce sync.Once
+	cb       func(Event)
+	mux      sync.Mutex
+}
+
+// Returns true for pattern segments matching any key, that is "*" and named
+// captures like "$id"
+func isWildcard(segment string) bool {
+	return segment == "*" || strings.HasPrefix(segment, "$")
+}
+
+// Returns keys matched by named captures of pattern, or nil if it has none
+func bindings(pattern []string, path []string) map[string]string {
+	for _, segment := range pattern {
+		if strings.HasPrefix(segment, "$") {
+			result := map[string]string{}
+			bind(pattern, path, result)
+			return result
 		}
+	}
 
-		if len(pattern) > 1 {
-			result := [][]string{}
+	return nil
+}
 
-			for _, key := range keys {
-				for _, path := range matches(yson.Get(json, key), pattern[1:]) {
-					result = append(result, append([]string{key}, path...))
-				}
-			}
+// Aligns pattern with path and stores keys matched by named captures
+func bind(pattern []string, path []string, result map[string]string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
 
-			return result
-		} else {
-			result := [][]string{}
-			for _, key := range keys {
-				result = append(result, []string{key})
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if bind(pattern[1:], path[i:], result) {
+				return true
 			}
-			return result
 		}
+
+		return false
+	}
+
+	if len(path) == 0 || !isWildcard(pattern[0]) && pattern[0] != path[0] {
+		return false
+	}
+
+	if strings.HasPrefix(pattern[0], "$") {
+		result[pattern[0][1:]] = path[0]
+	}
+
+	return bind(pattern[1:], path[1:], result)
+}
+
+// Returns paths matching pattern. Besides keys pattern can contain "*" or
+// named captures like "$id" that match any key, and "**" that matches any
+// number of keys, including none.
+func matches(tree node, pattern []string) [][]string {
+	if len(pattern) == 0 {
+		return [][]string{}
+	}
+
+	return unique(matchesFrom(tree, pattern))
+}
+
+// Returns paths relative to tree matching pattern, empty path means tree
+// itself matches and is only returned for patterns made of "**"
+func matchesFrom(tree node, pattern []string) [][]string {
+	if tree == nil {
+		return [][]string{}
+	}
+
+	if len(pattern) == 0 {
+		return [][]string{{}}
+	}
+
+	result := [][]string{}
+
+	if pattern[0] == "**" {
+		result = append(result, matchesFrom(tree, pattern[1:])...)
+
+		tree.eachChild(func(key string, value node) {
+			result = append(result, prepend(key, matchesFrom(value, pattern))...)
+		})
+
+		return result
+	}
+
+	if isWildcard(pattern[0]) {
+		tree.eachChild(func(key string, value node) {
+			result = append(result, prepend(key, matchesFrom(value, pattern[1:]))...)
+		})
+	} else if value := tree.child(pattern[0]); value != nil {
+		result = append(result, prepend(pattern[0], matchesFrom(value, pattern[1:]))...)
+	}
+
+	return result
+}
+
+// Like matchesFrom, but only descends along given path, so it returns
+// matching ancestors of the path, the path itself and its matching descendants
+func matchesAlong(tree node, pattern []string, path []string) [][]string {
+	if len(path) == 0 || len(pattern) == 0 {
+		return matchesFrom(tree, pattern)
+	}
+
+	key := path[0]
+	value := getNode(tree, key)
+
+	if pattern[0] == "**" {
+		result := matchesAlong(tree, pattern[1:], path)
+
+		if value != nil {
+			result = append(result, prepend(key, matchesAlong(value, pattern, path[1:]))...)
+		}
+
+		return result
+	}
+
+	if value == nil || !isWildcard(pattern[0]) && pattern[0] != key {
+		return [][]string{}
+	}
+
+	return prepend(key, matchesAlong(value, pattern[1:], path[1:]))
+}
+
+func prepend(key string, paths [][]string) [][]string {
+	for i, path := range paths {
+		paths[i] = append([]string{key}, path...)
+	}
+
+	return paths
+}
+
+// Removes duplicate and empty paths, and sorts the rest with sortPaths
+func unique(paths [][]string) [][]string {
+	result := [][]string{}
+	seen := map[string]struct{}{}
+
+	for _, path := range paths {
+		key := strings.Join(path, "/")
+
+		if _, ok := seen[key]; !ok && len(path) > 0 {
+			seen[key] = struct{}{}
+			result = append(result, path)
+		}
+	}
+
+	sortPaths(result)
+
+	return result
+}
+
+// Like matches, but only returns paths that could be affected by changes at
+// given paths. If there are no changed paths whole tree is matched.
+func matchesWithin(tree node, pattern []string, changed [][]string) [][]string {
+	if len(changed) == 0 || len(pattern) == 0 {
+		return matches(tree, pattern)
+	}
+
+	result := [][]string{}
+
+	for _, path := range changed {
+		result = append(result, matchesAlong(tree, pattern, path)...)
 	}
 
-	return [][]string{}
+	return unique(result)
 }
 
 func has(paths [][]string, path []string) bool {
@@ -99,8 +293,71 @@ func (w *Listener) shutdown() {
 	w.cursor.stream.removeListen(w)
 }
 
-func (w *Listener) call(event event) {
-	w.cb(event.Path, event.Prev, event.Curr)
+func (w *Listener) call(event Event) {
+	// Listener could be removed by previous call of this update
+	if w.removed {
+		return
+	}
+
+	// Async listener that stopped itself waits to be detached
+	if w.isStopped() {
+		return
+	}
+
+	event.Bindings = bindings(w.cursor.path, event.Path)
+	event.Revision = w.cursor.stream.revision
+
+	// Batch listener gets events once the whole value is processed
+	if w.batch != nil {
+		w.pending = append(w.pending, event)
+		return
+	}
+
+	defer w.recover(event.Path)
+
+	w.cb(event)
+}
+
+// Calls batch listener with events collected since the last flush
+func (w *Listener) flush() {
+	if w.batch == nil || len(w.pending) == 0 {
+		return
+	}
+
+	events := w.pending
+	w.pending = nil
+
+	if w.removed {
+		return
+	}
+
+	defer w.recover(events[0].Path)
+
+	w.batch(events)
+}
+
+// Recovers panic of callback and removes listener that panics too often. It
+// must be deferred with processMux held.
+func (w *Listener) recover(path []string) {
+	if rec := recover(); rec != nil && w.panicked(path, rec) {
+		w.cursor.stream.detach(w)
+		w.removed = true
+		w.disposeScopes()
+	}
+}
+
+// Reports panic of callback and tells if listener panics too often
+func (w *Listener) panicked(path []string, rec interface{}) bool {
+	stream := w.cursor.stream
+
+	stream.pubError(newError(PanicError, errors.Errorf(
+		"listener for %s panicked at %s: %v",
+		strings.Join(w.cursor.path, "/"), strings.Join(path, "/"), rec,
+	)))
+
+	w.panics++
+
+	return stream.maxPanics > 0 && w.panics >= stream.maxPanics
 }
 
 func reverse(ss [][]string) {
@@ -110,50 +367,94 @@ func reverse(ss [][]string) {
 	}
 }
 
-func (w *Listener) processRemove(value []byte) {
-	previous := w.value
+// Listener that missed previous value must compare the whole tree to nothing
+func (w *Listener) baseline(previous node, paths [][]string) (node, [][]string) {
+	if !w.synced {
+		return nil, nil
+	}
+
+	return previous, paths
+}
+
+func (w *Listener) processRemove(previous node, value node, paths [][]string) {
+	previous, changed := w.baseline(previous, paths)
 
-	prevMatches := matches(previous, w.cursor.path)
-	currMatches := matches(value, w.cursor.path)
+	prevMatches := matchesWithin(previous, w.cursor.path, changed)
+	currMatches := matchesWithin(value, w.cursor.path, changed)
 
 	reverse(prevMatches)
 	for _, prevMatch := range prevMatches {
 		if !has(currMatches, prevMatch) {
-			w.call(event{Path: prevMatch, Prev: yson.Get(previous, prevMatch...)})
+			w.call(Event{Kind: Removed, Path: prevMatch, Prev: getNode(previous, prevMatch...).json()})
 		}
 	}
 }
 
-func (w *Listener) processChange(value []byte) {
-	previous := w.value
+func (w *Listener) processChange(previous node, value node, paths [][]string) {
+	previous, changed := w.baseline(previous, paths)
 
-	currMatches := matches(value, w.cursor.path)
+	currMatches := matchesWithin(value, w.cursor.path, changed)
 
 	for _, currMatch := range currMatches {
-		prev := yson.Get(previous, currMatch...)
-		curr := yson.Get(value, currMatch...)
+		curr := getNode(value, currMatch...).json()
+		prevNode := getNode(previous, currMatch...)
 
-		if bytes.Compare(prev, curr) != 0 {
-			w.call(event{Path: currMatch, Prev: prev, Curr: curr})
+		if prevNode == nil {
+			w.call(Event{Kind: Added, Path: currMatch, Curr: curr})
+		} else if prev := prevNode.json(); bytes.Compare(prev, curr) != 0 {
+			w.call(Event{Kind: Changed, Path: currMatch, Prev: prev, Curr: curr})
 		}
 
 	}
 
-	w.value = value
+	w.synced = true
 }
 
-func (w *Stream) Push(value []byte) {
-	w.mux.Lock()
-	defer w.mux.Unlock()
+// Push sends new value of the whole tree to the stream without blocking. It
+// returns ErrStreamClosed without doing anything if the stream has been shut down.
+// Stream becomes synced once first pushed value is processed. Value that isn't
+// valid json is reported to ErrHandler as DecodeError and ignored.
+func (w *Stream) Push(value []byte) error {
+	return w.push(update{value: value, sync: true})
+}
 
-Loop:
-	for {
-		select {
-		case w.in <- value:
-			break Loop
-		default:
-		}
+// PushChange is like Push, but also tells which paths have changed since
+// previously pushed value, so only listeners interested in them are notified.
+// Paths of removed nodes need to be included as well. If no paths are given
+// the whole tree is compared.
+func (w *Stream) PushChange(value []byte, paths ...[]string) error {
+	return w.push(update{value: value, paths: paths, sync: len(paths) == 0})
+}
+
+func (w *Stream) push(u update) error {
+	if w.ctx.Err() != nil {
+		return ErrStreamClosed
 	}
+
+	w.box.put(u)
+
+	return nil
+}
+
+// Ready returns channel closed once the stream has processed initial data,
+// that is the first value read from file or sent to root path by firebase
+func (w *Stream) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// IsSynced returns true if the stream has processed initial data. If
+// UnsyncOnReconnect option is set, it's false while reconnecting to firebase.
+func (w *Stream) IsSynced() bool {
+	return atomic.LoadInt32(&w.synced) == 1
+}
+
+// Stats returns counters of values pushed to the stream
+func (w *Stream) Stats() StreamStats {
+	stats := w.box.Stats()
+	stats.DroppedErrors = atomic.LoadUint64(&w.droppedErrors)
+	stats.DroppedEvents = atomic.LoadUint64(&w.droppedEvents)
+
+	return stats
 }
 
 func keys(json []byte) map[string]struct{} {
@@ -166,79 +467,215 @@ func keys(json []byte) map[string]struct{} {
 	return set
 }
 
+// Makes process re-apply current value so new listeners catch up with it
 func (w *Stream) refresh() {
-	w.Push(w.value)
+	select {
+	case w.refreshChan <- struct{}{}:
+	default:
+	}
 }
 
 func (w *Stream) process() {
 	for {
 		select {
-		case value := <-w.in:
-			w.processSingle(value)
-		case <-w.stop:
-			for {
-				_, ok := <-w.in
-
-				if !ok {
+		case <-w.box.signal:
+			for _, u := range w.box.take() {
+				if w.ctx.Err() != nil {
 					break
 				}
+
+				w.processSingle(u)
 			}
+		case <-w.refreshChan:
+			w.processRefresh()
+		case <-w.ctx.Done():
+			w.teardown()
 			return
 		}
 	}
 }
 
-func (w *Stream) processSingle(value []byte) {
+// Closes ShutdownChan and removes all listeners, called once by process
+func (w *Stream) teardown() {
+	close(w.ShutdownChan)
+
+	w.processMux.Lock()
+	listeners := append([]*Listener{}, w.listeners...)
+	w.processMux.Unlock()
+
+	for i := len(listeners) - 1; i >= 0; i-- {
+		listeners[i].shutdown()
+	}
+}
+
+func (w *Stream) processSingle(u update) {
 	w.processMux.Lock()
 	defer w.processMux.Unlock()
 
-	w.value = value
+	w.registerAdded()
 
-	for i := len(w.listeners) - 1; i >= 0; i-- {
-		w.listeners[i].processRemove(value)
+	previous, paths, ok := w.apply(u)
+
+	if !ok {
+		return
 	}
 
-	for i := 0; i < len(w.listeners); i++ {
-		w.listeners[i].processChange(value)
+	value := treeNode{value: w.tree}
+
+	listeners := w.index.affected(paths, w.unsynced...)
+	w.unsynced = nil
+
+	for i := len(listeners) - 1; i >= 0; i-- {
+		listeners[i].processRemove(previous, value, paths)
+	}
+
+	for i := 0; i < len(listeners); i++ {
+		listeners[i].processChange(previous, value, paths)
+	}
+
+	for i := 0; i < len(listeners); i++ {
+		listeners[i].flush()
+	}
+
+	if u.sync {
+		atomic.StoreInt32(&w.synced, 1)
+		w.readyOnce.Do(func() {
+			close(w.ready)
+		})
 	}
 }
 
-func (w *Stream) pubError(err error) {
-	w.wg.Add(1)
-	go func() {
-		defer w.wg.Done()
-		w.errHandler(err)
-	}()
+// Makes update the current tree and returns the previous one along with
+// changed paths. Tree is changed in place, so the previous one is read through
+// undo log. It must be called with processMux held.
+func (w *Stream) apply(u update) (node, [][]string, bool) {
+	w.treeMux.Lock()
+	defer w.treeMux.Unlock()
+
+	previous := treeNode{value: w.tree}
+	paths := u.paths
+	tree := w.tree
+
+	if u.value != nil {
+		decoded, err := decodeTree(u.value)
+
+		if err != nil {
+			w.pubError(newError(DecodeError, errors.Wrap(err, "failed to decode value")))
+			return nil, nil, false
+		}
+
+		tree = decoded
+	} else {
+		previous.undo = newUndoLog()
+	}
+
+	for _, op := range u.ops {
+		var pruned [][]string
+
+		tree, pruned = op.apply(tree, previous.undo)
+
+		if len(paths) > 0 {
+			paths = append(paths, pruned...)
+		}
+	}
+
+	w.tree = tree
+	w.revision++
+
+	return previous, paths, true
 }
 
-// Shuts down stream and all its descendants
-func (w *Stream) Shutdown() {
-	w.shutdownMux.Lock()
-	defer w.shutdownMux.Unlock()
+// Notifies new listeners about current value
+func (w *Stream) processRefresh() {
+	w.processMux.Lock()
+	defer w.processMux.Unlock()
 
-	if w.stopped {
-		return
+	w.registerAdded()
+
+	listeners := w.unsynced
+	w.unsynced = nil
+
+	for i := 0; i < len(listeners); i++ {
+		listeners[i].processChange(nil, treeNode{value: w.tree}, nil)
+		listeners[i].flush()
 	}
+}
 
-	w.stopped = true
+// Queues error for errHandler. Errors are dropped when the queue is full, so
+// slow handler can't block the stream or pile up goroutines.
+func (w *Stream) pubError(err error) {
+	select {
+	case w.errs <- err:
+	default:
+		atomic.AddUint64(&w.droppedErrors, 1)
+	}
+}
 
-	close(w.ShutdownChan)
+// Reports event dropped because listener at cursor couldn't keep up
+func (w *Stream) dropEvent(cursor *cursor, event Event) {
+	atomic.AddUint64(&w.droppedEvents, 1)
 
-	w.mux.Lock()
-	defer w.mux.Unlock()
+	w.pubError(newError(OverflowError, errors.Errorf(
+		"listener for %s dropped %s event at %s",
+		strings.Join(cursor.path, "/"), event.Kind, strings.Join(event.Path, "/"),
+	)))
+}
 
-	for i := len(w.listeners) - 1; i >= 0; i-- {
-		w.listeners[i].shutdown()
+func (w *Stream) deliverErrors() {
+	for {
+		select {
+		case err := <-w.errs:
+			w.errHandler(err)
+		case <-w.ctx.Done():
+			// Deliver errors that happened during shutdown
+			for {
+				select {
+				case err := <-w.errs:
+					w.errHandler(err)
+				default:
+					return
+				}
+			}
+		}
 	}
+}
+
+// Shuts down stream and all its descendants
+func (w *Stream) Shutdown() {
+	w.Close()
+}
 
+// Close shuts down the stream the same way cancelling its context does,
+// waits for all its goroutines to finish, and returns failures they haven't
+// recovered from, like watched file that can't be parsed or connection to
+// firebase that's being retried. It's safe to call Close multiple times.
+func (w *Stream) Close() error {
+	w.cancel()
 	w.wg.Wait()
+
+	if w.info != nil {
+		if err := w.info.Close(); err != nil {
+			w.teardownMux.Lock()
+			w.teardownErrs = append(w.teardownErrs, errors.Wrap(err, "info"))
+			w.teardownMux.Unlock()
+		}
+	}
+
+	w.teardownMux.Lock()
+	defer w.teardownMux.Unlock()
+
+	if len(w.teardownErrs) > 0 {
+		return teardownError(w.teardownErrs)
+	}
+
+	return nil
 }
 
-func (s *Stream) publishFile(path string) {
+func (s *Stream) publishFile(path string) error {
 	contents, err := ioutil.ReadFile(path)
 
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "failed to read file")
 	}
 
 	buffer := new(bytes.Buffer)
@@ -246,186 +683,383 @@ func (s *Stream) publishFile(path string) {
 	err = json.Compact(buffer, contents)
 
 	if err != nil {
-		panic(err)
+		return newError(DecodeError, errors.Wrap(err, "failed to parse file"))
 	}
 
 	s.Push(buffer.Bytes())
+
+	return nil
 }
 
 func (w *Stream) Async(fn func(), label string) {
+	w.async(func() error {
+		fn()
+		return nil
+	}, label)
+}
+
+// Runs fn in goroutine owned by the stream. Returned error is passed to
+// errHandler, or reported by Close if the stream is already shutting down.
+func (w *Stream) async(fn func() error, label string) {
 	w.wg.Add(1)
 	go func() {
 		defer w.wg.Done()
-		fn()
+
+		err := fn()
+
+		if err == nil {
+			return
+		}
+
+		err = errors.Wrap(err, label)
+
+		select {
+		case <-w.ctx.Done():
+			w.teardownMux.Lock()
+			w.teardownErrs = append(w.teardownErrs, err)
+			w.teardownMux.Unlock()
+		default:
+			w.pubError(err)
+		}
 	}()
 }
 
 func (w *Stream) WatchFile(path string) *Stream {
-	var err error
+	if w.ctx.Err() != nil {
+		return w
+	}
 
-	go w.process()
+	// Failure of the latest attempt to read the file. It's reported by Close
+	// if the file is still broken when the stream shuts down.
+	var failure error
 
-	w.publishFile(path)
+	// The same failure repeats on each poll, but it's reported once
+	fail := func(err error) {
+		if failure == nil || failure.Error() != err.Error() {
+			w.pubError(err)
+		}
+
+		failure = err
+	}
 
-	wtch := watcher.New()
+	info, err := os.Stat(path)
+
+	if err != nil {
+		fail(errors.Wrap(err, "failed to watch file"))
+	} else if err := w.publishFile(path); err != nil {
+		fail(err)
+	}
 
-	wtch.SetMaxEvents(1)
+	// File is polled directly, as radovskyb/watcher leaks its polling
+	// goroutine when it's closed in the middle of a cycle
+	w.async(func() error {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
 
-	w.Async(func() {
 		for {
 			select {
-			case <-wtch.Event:
-				w.publishFile(path)
-			case <-w.ShutdownChan:
-				wtch.Close()
-				return
+			case <-ticker.C:
+				curr, err := os.Stat(path)
+
+				if err != nil {
+					fail(errors.Wrap(err, "failed to watch file"))
+					break
+				}
+
+				if info == nil || !curr.ModTime().Equal(info.ModTime()) || curr.Size() != info.Size() {
+					info = curr
+
+					if err := w.publishFile(path); err != nil {
+						fail(err)
+					} else {
+						failure = nil
+					}
+				}
+			case <-w.ctx.Done():
+				return failure
 			}
 		}
 	}, "filewatch")
 
-	err = wtch.Add(path)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return w
+}
 
-	w.Async(func() {
-		if err := wtch.Start(time.Second); err != nil {
-			log.Fatalln(err)
-		}
-	}, "watcherstart")
+func NewStream(errHandler func(error)) *Stream {
+	return NewStreamContext(context.Background(), StreamOptions{ErrHandler: errHandler})
+}
+
+// NewStreamContext creates a stream that shuts down when ctx is cancelled,
+// together with its watchers and listeners.
+func NewStreamContext(ctx context.Context, opts StreamOptions) *Stream {
+	w := newStream(ctx, opts)
+
+	w.info = newStream(w.ctx, StreamOptions{ErrHandler: w.errHandler})
+	w.info.Push(w.connection.json())
 
 	return w
 }
 
-func NewStream(errHandler func(error)) *Stream {
-	return &Stream{
+func newStream(ctx context.Context, opts StreamOptions) *Stream {
+	errHandler := opts.ErrHandler
+
+	if errHandler == nil {
+		errHandler = func(err error) {
+			log.Println(err)
+		}
+	}
+
+	errorBuffer := opts.ErrorBuffer
+
+	if errorBuffer <= 0 {
+		errorBuffer = 64
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	w := &Stream{
+		ctx:          ctx,
+		cancel:       cancel,
 		errHandler:   errHandler,
+		errs:         make(chan error, errorBuffer),
+		maxPanics:    opts.MaxPanics,
 		listeners:    []*Listener{},
+		index:        newPatternIndex(),
 		ShutdownChan: make(chan struct{}),
-		stop:         make(chan struct{}),
-		in:           make(chan []byte, 1),
+		ready:        make(chan struct{}),
+		unsync:       opts.UnsyncOnReconnect,
+		box:          newMailbox(opts.Strict),
+		refreshChan:  make(chan struct{}, 1),
 	}
+
+	w.Async(w.process, "process")
+	w.Async(w.deliverErrors, "errors")
+
+	return w
 }
 
 func (w *Stream) WatchFirebase(r *firebase.DatabaseRef) *Stream {
-	w.Async(w.process, "process")
+	return w.WatchFirebaseQuery(r, nil)
+}
 
-	// By default the value is nil, but we don't send it through channel
-	var js interface{}
+// WatchFirebaseQuery is like WatchFirebase, but only children of r matching
+// the query are streamed, for example NewQuery(OrderByKey()).LimitToLast(100).
+// Children that leave the query are removed from the stream.
+func (w *Stream) WatchFirebaseQuery(r *firebase.DatabaseRef, query *Query) *Stream {
+	return w.WatchFirebaseWith(r, FirebaseOptions{Query: query})
+}
+
+// WatchFirebaseWith is like WatchFirebase, but allows to configure query,
+// reconnection policy and keep-alive deadlines
+func (w *Stream) WatchFirebaseWith(r *firebase.DatabaseRef, options FirebaseOptions) *Stream {
+	if w.ctx.Err() != nil {
+		return w
+	}
+
+	options = options.withDefaults()
+	query := options.Query
+	bf := &retryLimit{BackOff: options.Backoff, max: options.MaxRetryDuration}
+
+	var opts []firebase.QueryOption
+
+	if query != nil {
+		opts = query.firebaseOptions()
+	}
 
 	operation := func() (err error) {
 		defer func() {
 			if rec := recover(); rec != nil {
 				switch r := rec.(type) {
 				case error:
-					err = r
+					err = newError(ProtocolError, r)
 				default:
-					err = errors.New(fmt.Sprintf("%s", err))
+					err = errorf(ProtocolError, "%v", r)
 				}
 			}
 		}()
 
-		ctx, cancel := context.WithCancel(context.Background())
+		ctx, cancel := context.WithCancel(w.ctx)
 
 		defer cancel()
 
-		evs, err := r.Watch(ctx)
+		w.setConnectionState(func(s *ConnectionState) {
+			s.Status = Connecting
+			s.NextRetry = time.Time{}
+		})
+
+		evs, err := r.Watch(ctx, opts...)
 
 		if err != nil {
-			return errors.Wrap(err, "failed to watch")
+			return newError(TransientError, errors.Wrap(err, "failed to watch"))
 		}
 
-		t := timer.NewTimer(time.Second * 60)
+		w.setConnectionState(func(s *ConnectionState) {
+			s.Status = Connected
+			s.Attempt = 0
+		})
+
+		bf.Reset()
+
+		t := timer.NewTimer(options.InitialKeepAlive)
+
+		defer t.Stop()
 
 		for {
 			select {
 			case e := <-evs:
 				if e == nil {
-					return errors.New("streaming ended")
+					return errorf(TransientError, "streaming ended")
 				}
 
 				if e.Type == firebase.EventTypeCancel {
-					return errors.New("streaming cancelled")
+					return errorf(PermissionError, "streaming cancelled")
 				}
 
 				if e.Type == firebase.EventTypeClosed {
-					return errors.New("streaming closed")
+					return errorf(TransientError, "streaming closed")
 				}
 
 				if e.Type == firebase.EventTypeAuthRevoked {
-					return errors.New("streaming auth revoked")
+					return errorf(AuthError, "streaming auth revoked")
 				}
 
 				// Not only for firebase.EventTypeKeepAlive
 				// as other keep-alives don't arrive if other values do
 				// One can expect at least one event every 30 seconds
-				t.Reset(time.Second * 40)
+				t.Reset(options.KeepAlive)
 
 				if e.Type == firebase.EventTypePut || e.Type == firebase.EventTypePatch {
 					payload, err := j.NewJson(e.Data)
 
 					if err != nil {
 						// We don't return an error because we don't need to re-esablish link
-						w.pubError(errors.Wrap(err, "failed to parse event data"))
+						w.pubError(newError(DecodeError, errors.Wrap(err, "failed to parse event data")))
 						break
 					}
 
 					path, err := payload.GetPath("path").String()
 
 					if err != nil {
-						w.pubError(errors.Wrap(err, "failed to parse event path"))
+						w.pubError(newError(DecodeError, errors.Wrap(err, "failed to parse event path")))
 						break
 					}
 
 					data := payload.Get("data").Interface()
 
-					if e.Type == firebase.EventTypePut {
-						js = Put(js, path, data)
-					} else {
-						js = Patch(js, path, data)
-					}
+					// Tree is changed by the process goroutine, so only the
+					// changed part of it is handled for each event
+					op := treeOp{path: splitPath(path), data: data, query: query}
+					changed := [][]string{op.path}
 
-					str, err := json.Marshal(js)
+					if e.Type == firebase.EventTypePatch {
+						op.patch = true
+						changed = patchedPaths(path, data)
 
-					if err != nil {
-						w.pubError(errors.Wrap(err, "failed to marshal json"))
-						break
+						if len(changed) == 0 {
+							break
+						}
 					}
 
-					w.Push(str)
+					// Firebase sends all data to root path after connecting
+					w.push(update{ops: []treeOp{op}, paths: changed, sync: e.Type == firebase.EventTypePut && path == "/"})
 				}
 			case <-t.C:
-				return errors.New("failed to receive keep-alive signal")
-			case <-w.ShutdownChan:
+				return errorf(TransientError, "failed to receive keep-alive signal")
+			case <-ctx.Done():
 				return nil
 			}
 		}
 	}
 
+	// Lets the policy decide whether failed attempt should be retried
+	attempt := func() error {
+		err := operation()
+
+		// Connection interrupted by shutdown hasn't failed
+		if err == nil || w.ctx.Err() != nil {
+			return nil
+		}
+
+		var classified *Error
+
+		if !errors.As(err, &classified) {
+			classified = newError(TransientError, err)
+		}
+
+		switch options.ErrorPolicy(classified, w.ConnectionState()) {
+		case Stop:
+			return backoff.Permanent(classified)
+		case RefreshCredentials:
+			if options.Refresh == nil {
+				break
+			}
+
+			ref, refreshErr := options.Refresh(w.ctx)
+
+			if refreshErr != nil {
+				w.pubError(newError(AuthError, errors.Wrap(refreshErr, "failed to refresh credentials")))
+				break
+			}
+
+			r = ref
+		}
+
+		return classified
+	}
+
 	notify := func(err error, next time.Duration) {
+		w.setConnectionState(func(s *ConnectionState) {
+			s.Status = Reconnecting
+			s.Attempt++
+			s.NextRetry = time.Now().Add(next)
+			s.LastError = err
+		})
+
+		if w.unsync {
+			atomic.StoreInt32(&w.synced, 0)
+		}
+
 		w.pubError(err)
 	}
 
-	w.Async(func() {
-		bf := backoff.NewExponentialBackOff()
-		bf.MaxElapsedTime = 0
-		err := backoff.RetryNotify(operation, bf, notify)
+	w.async(func() error {
+		err := backoff.RetryNotify(attempt, backoff.WithContext(bf, w.ctx), notify)
 
-		if err != nil {
-			// Should not ever happen with this MaxElapsedTime
-			panic(err)
+		w.setConnectionState(func(s *ConnectionState) {
+			s.Status = Disconnected
+			s.NextRetry = time.Time{}
+
+			if err != nil {
+				s.LastError = err
+			}
+		})
+
+		if err == nil {
+			return nil
 		}
+
+		// Stream was shut down while waiting to reconnect, so Close reports
+		// the failure that wasn't recovered from
+		if w.ctx.Err() != nil {
+			return errors.Wrap(err, "closed while reconnecting")
+		}
+
+		// Error policy says to stop or MaxRetryDuration is exceeded
+		return errors.Wrap(err, "gave up reconnecting")
 	}, "backoff")
 
 	return w
 }
 
 func (w *Stream) Select(path ...string) *cursor {
+	if len(path) > 0 && path[0] == ".info" && w.info != nil {
+		return &cursor{stream: w.info, path: path}
+	}
+
 	return &cursor{stream: w, path: path}
 }
 
 func (c *cursor) Select(path ...string) *cursor {
-	return &cursor{stream: c.stream, path: append(c.path, path...)}
+	return c.stream.Select(append(c.path[:len(c.path):len(c.path)], path...)...)
 }
 
 type cursor struct {
@@ -433,7 +1067,65 @@ type cursor struct {
 	path   []string
 }
 
+// Listen calls cb whenever value at a path matching pattern is added, changed
+// or removed, prev is nil for added values and curr for removed ones. Pattern
+// segments "*" and "$name" match any key, and "**" matches any number of keys.
+// With "**" matched paths can be nested in each other, then each of them gets
+// its own events, so change of a nested value is reported for all matched
+// paths containing it.
+//
+// Events of one value are passed in order of their paths, removals from the
+// last path to the first and then other changes from the first path to the
+// last. Paths are compared key by key, with parents before their children, and
+// keys are ordered like in firebase: keys that are 32-bit integers go first and
+// are sorted numerically.
 func (c *Stream) Listen(pattern []string, cb func(path []string, prev []byte, curr []byte)) *Listener {
+	return c.listen(c.Select(pattern...), func(event Event) {
+		cb(event.Path, event.Prev, event.Curr)
+	})
+}
+
+// ListenBindings is like Listen, but callback also receives keys matched by
+// named captures in the pattern. For example pattern
+// []string{"managers", "$manager"} matching path []string{"managers", "foo"}
+// gives bindings map[string]string{"manager": "foo"}.
+func (c *Stream) ListenBindings(pattern []string, cb func(path []string, bindings map[string]string, prev []byte, curr []byte)) *Listener {
+	return c.listen(c.Select(pattern...), func(event Event) {
+		cb(event.Path, event.Bindings, event.Prev, event.Curr)
+	})
+}
+
+// ListenOrdered is like ListenEvents, but children of each node matched by
+// pattern without its last segment are kept sorted in given order. Events tell
+// key of previous sibling, and Moved event follows Changed event if the change
+// has moved the child to another position, like firebase's child_moved.
+// Ordered children must be siblings, so it fails if pattern is empty or ends
+// with "**".
+func (c *Stream) ListenOrdered(pattern []string, order Order, cb func(Event)) (*Listener, error) {
+	if len(pattern) == 0 {
+		return nil, errors.New("ListenOrdered pattern can't be empty")
+	}
+
+	if pattern[len(pattern)-1] == "**" {
+		return nil, errors.New(`ListenOrdered pattern can't end with "**"`)
+	}
+
+	query := c.Select(pattern[:len(pattern)-1]...).Query(order)
+	query.child = pattern[len(pattern)-1]
+
+	return query.Listen(cb), nil
+}
+
+// ListenBatch is like ListenEvents, but callback receives all events caused
+// by one processed value at once, for example by a patch touching many
+// children. Removals come first, and the callback isn't called if there are
+// no events.
+func (c *Stream) ListenBatch(pattern []string, cb func([]Event)) *Listener {
+	return c.add(&Listener{cursor: c.Select(pattern...), batch: cb})
+}
+
+// ListenEvents is like Listen, but callback receives kind of each change
+func (c *Stream) ListenEvents(pattern []string, cb func(Event)) *Listener {
 	return c.listen(c.Select(pattern...), cb)
 }
 
@@ -445,10 +1137,48 @@ func (w *Stream) removeListen(listener *Listener) bool {
 	w.processMux.Lock()
 	defer w.processMux.Unlock()
 
+	return w.unlisten(listener)
+}
+
+// Removes listener and notifies it about removal of its values. It must be
+// called with processMux held.
+func (w *Stream) unlisten(listener *Listener) bool {
+	if !w.detach(listener) {
+		return false
+	}
+
+	listener.processRemove(treeNode{value: w.tree}, nil, nil)
+	listener.flush()
+	listener.stop()
+	listener.disposeScopes()
+
+	return true
+}
+
+// Removes listener from the stream without notifying it. It must be called
+// with processMux held.
+func (w *Stream) detach(listener *Listener) bool {
+	w.addedMux.Lock()
+	for i, list := range w.added {
+		if list == listener {
+			w.added = remove(w.added, i)
+			listener.removed = true
+			break
+		}
+	}
+	w.addedMux.Unlock()
+
+	for i, list := range w.unsynced {
+		if list == listener {
+			w.unsynced = remove(w.unsynced, i)
+			break
+		}
+	}
+
 	for i, list := range w.listeners {
 		if list == listener {
 			w.listeners = remove(w.listeners, i)
-			listener.processRemove([]byte("{}"))
+			w.index.remove(listener.cursor.path, listener)
 			return true
 		}
 	}
@@ -456,22 +1186,134 @@ func (w *Stream) removeListen(listener *Listener) bool {
 	return false
 }
 
-func (w *Stream) listen(cursor *cursor, cb func(path []string, prev []byte, curr []byte)) *Listener {
+func (w *Stream) listen(cursor *cursor, cb func(Event)) *Listener {
+	return w.add(&Listener{cb: cb, cursor: cursor})
+}
+
+func (w *Stream) add(listener *Listener) *Listener {
+	// Cursor of synthetic path belongs to another stream
+	if listener.cursor.stream != w {
+		return listener.cursor.stream.add(listener)
+	}
+
 	w.processMux.Lock()
 	defer w.processMux.Unlock()
 
-	listener := &Listener{
-		cb:     cb,
-		cursor: cursor,
+	w.register(listener)
+	w.refresh()
+
+	return listener
+}
+
+// Adds listener without waiting for processMux, so it can be called from
+// callbacks. Listener is registered by the process goroutine.
+func (w *Stream) addLater(listener *Listener) *Listener {
+	if listener.cursor.stream != w {
+		return listener.cursor.stream.addLater(listener)
 	}
 
-	w.listeners = append(w.listeners, listener)
+	w.addedMux.Lock()
+	w.added = append(w.added, listener)
+	w.addedMux.Unlock()
 
-	w.Async(w.refresh, "refresh")
+	w.refresh()
 
 	return listener
 }
 
+// Removes listener without notifying it and without waiting for processMux,
+// so it can be called from any goroutine. Listener is detached by the process
+// goroutine.
+func (w *Stream) detachLater(listener *Listener) {
+	if listener.cursor.stream != w {
+		listener.cursor.stream.detachLater(listener)
+		return
+	}
+
+	w.addedMux.Lock()
+	w.detached = append(w.detached, listener)
+	w.addedMux.Unlock()
+
+	w.refresh()
+}
+
+// Removes listener like removeListen, but without waiting for processMux, so
+// it can be called with processMux of another stream held. Listener is
+// removed by the process goroutine.
+func (w *Stream) removeLater(listener *Listener) {
+	if listener.cursor.stream != w {
+		listener.cursor.stream.removeLater(listener)
+		return
+	}
+
+	w.addedMux.Lock()
+	w.removing = append(w.removing, listener)
+	w.addedMux.Unlock()
+
+	w.refresh()
+}
+
+// Registers listeners added with addLater and removes ones passed to
+// detachLater and removeLater. It must be called with processMux held.
+func (w *Stream) registerAdded() {
+	w.addedMux.Lock()
+	added, detached, removing := w.added, w.detached, w.removing
+	w.added, w.detached, w.removing = nil, nil, nil
+	w.addedMux.Unlock()
+
+	for _, listener := range added {
+		w.register(listener)
+	}
+
+	for _, listener := range detached {
+		w.detach(listener)
+		listener.removed = true
+		listener.disposeScopes()
+	}
+
+	for _, listener := range removing {
+		w.unlisten(listener)
+	}
+}
+
+// Registers listener to be notified about current value by processRefresh.
+// It must be called with processMux held.
+func (w *Stream) register(listener *Listener) {
+	cursor := listener.cursor
+
+	w.nextID++
+
+	listener.id = w.nextID
+
+	// Listeners registered after shutdown would never be removed
+	if w.ctx.Err() != nil {
+		listener.stop()
+		return
+	}
+
+	w.listeners = append(w.listeners, listener)
+	w.unsynced = append(w.unsynced, listener)
+	w.index.add(cursor.path, listener)
+}
+
+// Snapshot returns current value of the whole tree
+func (w *Stream) Snapshot() Snapshot {
+	return w.Select().Snapshot()
+}
+
+// Snapshot returns current value at cursor path. Only the value at the path
+// is encoded, so it's cheap for small parts of a big tree.
+func (w *cursor) Snapshot() Snapshot {
+	w.stream.treeMux.RLock()
+	defer w.stream.treeMux.RUnlock()
+
+	return Snapshot{
+		path:     w.path,
+		value:    nodeJSON(getNode(treeNode{value: w.stream.tree}, w.path...)),
+		revision: w.stream.revision,
+	}
+}
+
 func (w *cursor) Value() []byte {
-	return yson.Get(w.stream.value, w.path...)
+	return w.Snapshot().value
 }
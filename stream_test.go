@@ -1,9 +1,16 @@
 package firebasehelpers
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
 	"testing"
 
 	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
 )
 
 func TestMatches(t *testing.T) {
@@ -26,17 +33,19 @@ func TestMatches(t *testing.T) {
 					"fuz": "asdfa"
 				}
 			}
+		}
 	`)
 
 	pattern := []string{"managers", "*", "supervisors", "*"}
 
-	result := matches(json, pattern)
+	result := matches(decoded(json), pattern)
 
+	// Keys are matched in order, not in order of the document
 	expected := [][]string{
-		[]string{"managers", "foo", "supervisors", "fiz"},
-		[]string{"managers", "foo", "supervisors", "fuz"},
 		[]string{"managers", "bar", "supervisors", "no"},
 		[]string{"managers", "bar", "supervisors", "way"},
+		[]string{"managers", "foo", "supervisors", "fiz"},
+		[]string{"managers", "foo", "supervisors", "fuz"},
 	}
 
 	if diff := deep.Equal(expected, result); diff != nil {
@@ -64,15 +73,16 @@ func TestMatches2(t *testing.T) {
 					"fuz": "asdfa"
 				}
 			}
+		}
 	`)
 
 	pattern := []string{"managers", "*", "supervisors"}
 
-	result := matches(json, pattern)
+	result := matches(decoded(json), pattern)
 
 	expected := [][]string{
-		[]string{"managers", "foo", "supervisors"},
 		[]string{"managers", "bar", "supervisors"},
+		[]string{"managers", "foo", "supervisors"},
 	}
 
 	if diff := deep.Equal(expected, result); diff != nil {
@@ -85,7 +95,7 @@ func TestMatchesEmpty(t *testing.T) {
 
 	pattern := []string{"managers", "*", "supervisors"}
 
-	result := matches(json, pattern)
+	result := matches(decoded(json), pattern)
 
 	expected := [][]string{}
 
@@ -99,7 +109,7 @@ func TestMatchesEmpty2(t *testing.T) {
 
 	pattern := []string{"managers"}
 
-	result := matches(json, pattern)
+	result := matches(decoded(json), pattern)
 
 	expected := [][]string{
 		[]string{"managers"},
@@ -115,7 +125,7 @@ func TestMatchesEmpty3(t *testing.T) {
 
 	pattern := []string{}
 
-	result := matches(json, pattern)
+	result := matches(decoded(json), pattern)
 
 	expected := [][]string{}
 
@@ -147,3 +157,506 @@ func TestHasNot(t *testing.T) {
 		t.Error("Should match")
 	}
 }
+
+func TestStreamContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream := NewStreamContext(ctx, StreamOptions{})
+
+	added := make(chan []string, 1)
+	removed := make(chan []string, 1)
+
+	stream.Listen([]string{"foo"}, func(path []string, prev []byte, curr []byte) {
+		if curr == nil {
+			removed <- path
+		} else {
+			added <- path
+		}
+	})
+
+	stream.Push([]byte(`{"foo":"bar"}`))
+
+	assert.Equal(t, []string{"foo"}, <-added)
+
+	cancel()
+
+	assert.Equal(t, []string{"foo"}, <-removed)
+
+	<-stream.ShutdownChan
+
+	assert.Nil(t, stream.Close())
+}
+
+func TestStreamClose(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+
+	assert.Nil(t, stream.Close())
+	assert.Nil(t, stream.Close())
+
+	select {
+	case <-stream.ShutdownChan:
+	default:
+		t.Error("ShutdownChan should be closed")
+	}
+}
+
+// Timer package keeps one global goroutine for all timers
+func verifyNoLeaks(t *testing.T) {
+	goleak.VerifyNone(t, goleak.IgnoreTopFunction("github.com/desertbit/timer.timerRoutine"))
+}
+
+func TestPushAfterShutdown(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+
+	assert.Nil(t, stream.Push([]byte(`{"foo":"bar"}`)))
+
+	stream.Shutdown()
+
+	assert.Equal(t, ErrStreamClosed, stream.Push([]byte(`{"foo":"baz"}`)))
+}
+
+func TestShutdownLeak(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+
+	stream.Listen([]string{"*"}, func(path []string, prev []byte, curr []byte) {})
+
+	for _, value := range []string{`{"foo":"bar"}`, `{"foo":"baz"}`, `{"fiz":"fuz"}`} {
+		stream.Push([]byte(value))
+	}
+
+	stream.Shutdown()
+}
+
+func TestWatchFileShutdownLeak(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	file, err := ioutil.TempFile("", "stream")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"foo":"bar"}`)
+	file.Close()
+
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	}).WatchFile(file.Name())
+
+	received := make(chan []byte, 1)
+
+	stream.Listen([]string{"foo"}, func(path []string, prev []byte, curr []byte) {
+		if curr != nil {
+			received <- curr
+		}
+	})
+
+	assert.Equal(t, []byte(`"bar"`), <-received)
+
+	assert.Nil(t, stream.Close())
+}
+
+func TestWatchFileFailure(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	file, err := ioutil.TempFile("", "stream")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString(`{"foo":`)
+	file.Close()
+
+	errs := make(chan error, 10)
+
+	stream := NewStream(func(err error) {
+		errs <- err
+	}).WatchFile(file.Name())
+
+	assert.Equal(t, DecodeError, KindOf(<-errs))
+
+	err = stream.Close()
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "stream teardown failed: filewatch: failed to parse file")
+
+	stream = NewStream(func(err error) {}).WatchFile(file.Name() + ".missing")
+
+	assert.Error(t, stream.Close())
+}
+
+func TestStrictStream(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	received := make(chan string, 100)
+
+	stream.Listen([]string{"counter"}, func(path []string, prev []byte, curr []byte) {
+		received <- string(curr)
+	})
+
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		stream.Push([]byte(`{"counter":` + value + `}`))
+	}
+
+	for _, value := range []string{"1", "2", "3", "4", "5"} {
+		assert.Equal(t, value, <-received)
+	}
+
+	assert.Equal(t, uint64(0), stream.Stats().Coalesced)
+}
+
+func TestMatchesWithin(t *testing.T) {
+	json := []byte(`{"managers":{"foo":{"supervisors":{"fiz":"fiz"}},"bar":{"supervisors":{"no":"no","way":"way"}}}}`)
+
+	pattern := []string{"managers", "*", "supervisors", "*"}
+
+	assert.Equal(t, [][]string{
+		{"managers", "bar", "supervisors", "no"},
+		{"managers", "bar", "supervisors", "way"},
+	}, matchesWithin(decoded(json), pattern, [][]string{{"managers", "bar"}}))
+
+	assert.Equal(t, [][]string{
+		{"managers", "foo", "supervisors", "fiz"},
+	}, matchesWithin(decoded(json), pattern, [][]string{{"managers", "foo", "supervisors", "fiz", "deep"}, {"managers", "foo", "supervisors", "fiz"}}))
+
+	assert.Equal(t, [][]string{}, matchesWithin(decoded(json), pattern, [][]string{{"workers"}, {"managers", "baz"}}))
+
+	assert.Equal(t, matches(decoded(json), pattern), matchesWithin(decoded(json), pattern, [][]string{{}}))
+}
+
+func TestPushChange(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	events := make(chan Event, 100)
+
+	stream.Listen([]string{"*", "*"}, func(path []string, prev []byte, curr []byte) {
+		events <- Event{Path: path, Prev: prev, Curr: curr}
+	})
+
+	stream.Push([]byte(`{"a":{"x":1},"b":{"x":1}}`))
+	stream.PushChange([]byte(`{"a":{"x":2},"b":{"x":2}}`), []string{"a", "x"})
+	stream.PushChange([]byte(`{"b":{"x":2}}`), []string{"a"})
+
+	assert.Equal(t, Event{Path: []string{"a", "x"}, Curr: []byte("1")}, <-events)
+	assert.Equal(t, Event{Path: []string{"b", "x"}, Curr: []byte("1")}, <-events)
+	assert.Equal(t, Event{Path: []string{"a", "x"}, Prev: []byte("1"), Curr: []byte("2")}, <-events)
+	assert.Equal(t, Event{Path: []string{"a", "x"}, Prev: []byte("2")}, <-events)
+
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected event %v", e)
+	default:
+	}
+}
+
+func TestListenEvents(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	events := make(chan Event, 100)
+
+	stream.ListenEvents([]string{"*"}, func(event Event) {
+		events <- event
+	})
+
+	stream.Push([]byte(`{"a":1,"b":1}`))
+	stream.Push([]byte(`{"a":2,"c":1}`))
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"a"}, Curr: []byte("1"), Revision: 1}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"b"}, Curr: []byte("1"), Revision: 1}, <-events)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"b"}, Prev: []byte("1"), Revision: 2}, <-events)
+	assert.Equal(t, Event{Kind: Changed, Path: []string{"a"}, Prev: []byte("1"), Curr: []byte("2"), Revision: 2}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"c"}, Curr: []byte("1"), Revision: 2}, <-events)
+
+	stream.Shutdown()
+
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"c"}, Prev: []byte("1"), Revision: 2}, <-events)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"a"}, Prev: []byte("2"), Revision: 2}, <-events)
+}
+
+func TestMatchesCaptures(t *testing.T) {
+	json := []byte(`{"managers":{"foo":{"supervisors":{"fiz":"fiz"}},"bar":{"supervisors":{"no":"no"}}}}`)
+
+	assert.Equal(t, matches(decoded(json), []string{"managers", "*", "supervisors", "*"}), matches(decoded(json), []string{"managers", "$manager", "supervisors", "$supervisor"}))
+}
+
+func TestBindings(t *testing.T) {
+	assert.Equal(t,
+		map[string]string{"manager": "foo", "supervisor": "fiz"},
+		bindings([]string{"managers", "$manager", "supervisors", "$supervisor"}, []string{"managers", "foo", "supervisors", "fiz"}),
+	)
+
+	assert.Nil(t, bindings([]string{"managers", "*"}, []string{"managers", "foo"}))
+}
+
+func TestListenBindings(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+	defer stream.Shutdown()
+
+	received := make(chan map[string]string, 10)
+
+	stream.ListenBindings([]string{"managers", "$manager", "supervisors", "$supervisor"}, func(path []string, bindings map[string]string, prev []byte, curr []byte) {
+		received <- bindings
+	})
+
+	stream.Push([]byte(`{"managers":{"foo":{"supervisors":{"fiz":"fiz"}}}}`))
+
+	assert.Equal(t, map[string]string{"manager": "foo", "supervisor": "fiz"}, <-received)
+}
+
+func TestMatchesRecursive(t *testing.T) {
+	json := []byte(`{"config":{"a":1,"config":{"b":2}},"tenants":{"foo":{"config":{"c":3}},"bar":{"nested":{"config":4}}}}`)
+
+	// Paths are sorted, parents go before their children
+	assert.Equal(t, [][]string{
+		{"config"},
+		{"config", "config"},
+		{"tenants", "bar", "nested", "config"},
+		{"tenants", "foo", "config"},
+	}, matches(decoded(json), []string{"**", "config"}))
+
+	assert.Equal(t, [][]string{
+		{"tenants", "foo"},
+		{"tenants", "foo", "config"},
+		{"tenants", "foo", "config", "c"},
+	}, matches(decoded(json), []string{"tenants", "foo", "**"}))
+
+	assert.Equal(t, [][]string{
+		{"tenants", "bar", "nested", "config"},
+		{"tenants", "foo", "config"},
+	}, matches(decoded(json), []string{"tenants", "**", "*", "config"}))
+
+	// Path matched by "**" at the root doesn't go before paths of its siblings
+	assert.Equal(t, [][]string{
+		{"a", "config"},
+		{"config"},
+	}, matches(decoded([]byte(`{"a":{"config":1},"config":2}`)), []string{"**", "config"}))
+}
+
+func TestMatchesWithinRecursive(t *testing.T) {
+	json := []byte(`{"config":{"a":1,"config":{"b":2}},"tenants":{"foo":{"config":{"c":3}},"bar":{"nested":{"config":4}}}}`)
+
+	pattern := []string{"**", "config"}
+
+	assert.Equal(t, [][]string{
+		{"config"},
+		{"config", "config"},
+	}, matchesWithin(decoded(json), pattern, [][]string{{"config", "config", "b"}}))
+
+	assert.Equal(t, [][]string{
+		{"tenants", "bar", "nested", "config"},
+	}, matchesWithin(decoded(json), pattern, [][]string{{"tenants", "bar"}}))
+
+	assert.Equal(t, matches(decoded(json), pattern), matchesWithin(decoded(json), pattern, [][]string{{}}))
+}
+
+func TestBindingsRecursive(t *testing.T) {
+	assert.Equal(t,
+		map[string]string{"tenant": "bar"},
+		bindings([]string{"**", "$tenant", "nested", "config"}, []string{"tenants", "bar", "nested", "config"}),
+	)
+}
+
+func TestListenRecursive(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	events := make(chan Event, 10)
+
+	stream.ListenEvents([]string{"**", "config"}, func(event Event) {
+		events <- Event{Kind: event.Kind, Path: event.Path}
+	})
+
+	stream.Push([]byte(`{"config":{"config":1}}`))
+	stream.PushChange([]byte(`{"config":{"config":2}}`), []string{"config", "config"})
+	stream.PushChange([]byte(`{}`), []string{"config"})
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"config"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"config", "config"}}, <-events)
+	assert.Equal(t, Event{Kind: Changed, Path: []string{"config"}}, <-events)
+	assert.Equal(t, Event{Kind: Changed, Path: []string{"config", "config"}}, <-events)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"config", "config"}}, <-events)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"config"}}, <-events)
+}
+
+func TestListenArrayToObject(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	events := make(chan Event, 10)
+
+	stream.ListenEvents([]string{"items", "*"}, func(event Event) {
+		events <- Event{Kind: event.Kind, Path: event.Path}
+	})
+
+	stream.Push([]byte(`{"items":["foo","bar"]}`))
+	stream.Push([]byte(`{"items":{"0":"foo","1":"bar","5":"baz"}}`))
+	stream.Push([]byte(`{"items":["foo"]}`))
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"items", "0"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"items", "1"}}, <-events)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"items", "5"}}, <-events)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"items", "5"}}, <-events)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"items", "1"}}, <-events)
+}
+
+func TestReady(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+	defer stream.Shutdown()
+
+	assert.False(t, stream.IsSynced())
+
+	stream.PushChange([]byte(`{"foo":"bar"}`), []string{"foo"})
+	stream.Push([]byte(`{"foo":"baz"}`))
+
+	<-stream.Ready()
+
+	assert.True(t, stream.IsSynced())
+	assert.Equal(t, []byte(`"baz"`), stream.Select("foo").Value())
+}
+
+func TestErrorsAreBounded(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled []string
+
+	stream := NewStreamContext(context.Background(), StreamOptions{
+		ErrorBuffer: 2,
+		ErrHandler: func(err error) {
+			if len(handled) == 0 {
+				close(started)
+				<-release
+			}
+
+			handled = append(handled, err.Error())
+		},
+	})
+
+	stream.pubError(errors.New("0"))
+
+	<-started
+
+	for i := 1; i < 10; i++ {
+		stream.pubError(errors.New(strconv.Itoa(i)))
+	}
+
+	assert.Equal(t, uint64(7), stream.Stats().DroppedErrors)
+
+	close(release)
+	stream.Close()
+
+	assert.Equal(t, []string{"0", "1", "2"}, handled)
+}
+
+func TestListenerPanic(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	errs := make(chan error, 10)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{
+		MaxPanics: 2,
+		Strict:    true,
+		ErrHandler: func(err error) {
+			errs <- err
+		},
+	})
+	defer stream.Shutdown()
+
+	calls := make(chan []string, 10)
+
+	stream.Listen([]string{"managers", "*"}, func(path []string, prev []byte, curr []byte) {
+		panic("boom")
+	})
+
+	stream.Listen([]string{"managers", "*"}, func(path []string, prev []byte, curr []byte) {
+		calls <- path
+	})
+
+	stream.Push([]byte(`{"managers":{"foo":"1"}}`))
+
+	assert.Equal(t, []string{"managers", "foo"}, <-calls)
+
+	err := <-errs
+	assert.EqualError(t, err, "listener for managers/* panicked at managers/foo: boom")
+	assert.Equal(t, PanicError, KindOf(err))
+
+	stream.Push([]byte(`{"managers":{"foo":"2","bar":"1"}}`))
+
+	// Paths are passed in key order
+	assert.Equal(t, []string{"managers", "bar"}, <-calls)
+	assert.Equal(t, []string{"managers", "foo"}, <-calls)
+	assert.EqualError(t, <-errs, "listener for managers/* panicked at managers/bar: boom")
+
+	// The listener was removed after the second panic, removals come first
+	stream.Push([]byte(`{"managers":{"foo":"3"}}`))
+
+	assert.Equal(t, []string{"managers", "bar"}, <-calls)
+	assert.Equal(t, []string{"managers", "foo"}, <-calls)
+
+	stream.Close()
+
+	assert.Empty(t, errs)
+}
+
+func TestListenBatch(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+
+	batches := make(chan []Event, 10)
+
+	stream.ListenBatch([]string{"managers", "$manager"}, func(events []Event) {
+		batches <- events
+	})
+
+	stream.Push([]byte(`{"managers":{"foo":1,"bar":1}}`))
+
+	batch := <-batches
+
+	// Events are passed in key order
+	assert.Len(t, batch, 2)
+	assert.Equal(t, Added, batch[0].Kind)
+	assert.Equal(t, []string{"managers", "bar"}, batch[0].Path)
+	assert.Equal(t, Added, batch[1].Kind)
+	assert.Equal(t, []string{"managers", "foo"}, batch[1].Path)
+
+	stream.PushChange([]byte(`{"managers":{"foo":2,"baz":1},"other":1}`), []string{"managers"}, []string{"other"})
+
+	batch = <-batches
+
+	assert.Len(t, batch, 3)
+	assert.Equal(t, Removed, batch[0].Kind)
+	assert.Equal(t, []string{"managers", "bar"}, batch[0].Path)
+	assert.Equal(t, Added, batch[1].Kind)
+	assert.Equal(t, map[string]string{"manager": "baz"}, batch[1].Bindings)
+	assert.Equal(t, Changed, batch[2].Kind)
+	assert.Equal(t, map[string]string{"manager": "foo"}, batch[2].Bindings)
+	assert.Equal(t, uint64(2), batch[2].Revision)
+
+	// No events, no callback
+	stream.Push([]byte(`{"managers":{"foo":2,"baz":1},"other":2}`))
+
+	stream.Close()
+
+	batch = <-batches
+
+	assert.Len(t, batch, 2)
+	assert.Equal(t, Removed, batch[0].Kind)
+	assert.Empty(t, batches)
+}
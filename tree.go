@@ -0,0 +1,108 @@
+package firebasehelpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/sheerun/yson"
+)
+
+// Firebase returns nodes with mostly integer keys as arrays, where missing
+// keys are nulls. Functions below treat such arrays as objects with index keys.
+
+func isArray(value []byte) bool {
+	for _, c := range value {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case '[':
+			return true
+		}
+
+		return false
+	}
+
+	return false
+}
+
+// Calls fn with each non-null item of array and its index until it returns
+// false. Items are decoded one by one, so reading the beginning of an array
+// doesn't decode the rest of it.
+func eachItem(value []byte, fn func(index int, item []byte) bool) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return
+	}
+
+	for index := 0; decoder.More(); index++ {
+		var item json.RawMessage
+
+		if err := decoder.Decode(&item); err != nil {
+			return
+		}
+
+		if string(item) != "null" && !fn(index, item) {
+			return
+		}
+	}
+}
+
+// Returns value of direct child of object or array, or nil if it's missing
+func child(value []byte, key string) []byte {
+	if !isArray(value) {
+		return yson.Get(value, key)
+	}
+
+	index, err := strconv.Atoi(key)
+
+	if err != nil || index < 0 || strconv.Itoa(index) != key {
+		return nil
+	}
+
+	var result []byte
+
+	eachItem(value, func(i int, item []byte) bool {
+		if i == index {
+			result = item
+		}
+
+		return i < index
+	})
+
+	return result
+}
+
+// Returns value at path, or nil if it's missing
+func get(value []byte, path ...string) []byte {
+	if len(path) == 0 {
+		return yson.Get(value)
+	}
+
+	for _, key := range path {
+		value = child(value, key)
+
+		if value == nil {
+			return nil
+		}
+	}
+
+	return value
+}
+
+// Calls fn for each child of object or array in document order
+func eachChild(value []byte, fn func(key string, child []byte)) {
+	if !isArray(value) {
+		yson.EachKey(value, func(key []byte) {
+			fn(string(key), yson.Get(value, string(key)))
+		})
+
+		return
+	}
+
+	eachItem(value, func(index int, item []byte) bool {
+		fn(strconv.Itoa(index), item)
+		return true
+	})
+}
@@ -0,0 +1,58 @@
+package firebasehelpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetArray(t *testing.T) {
+	json := []byte(`{"items":[{"name":"foo"},null,{"name":"bar"}]}`)
+
+	assert.Equal(t, []byte(`"foo"`), get(json, "items", "0", "name"))
+	assert.Equal(t, []byte(`{"name":"bar"}`), get(json, "items", "2"))
+	assert.Nil(t, get(json, "items", "1"))
+	assert.Nil(t, get(json, "items", "3"))
+	assert.Nil(t, get(json, "items", "01"))
+	assert.Nil(t, get(json, "items", "name"))
+}
+
+func TestGetArrayReadsOnlyItemsBeforeIndex(t *testing.T) {
+	// Items after the index aren't decoded, so they can't break the lookup
+	json := []byte(`[1,{"name":"foo"},{"broken`)
+
+	assert.Equal(t, []byte(`{"name":"foo"}`), get(json, "1"))
+	assert.Equal(t, []byte(`"foo"`), get(json, "1", "name"))
+	assert.Nil(t, get(json, "2"))
+}
+
+func TestEachChildArray(t *testing.T) {
+	keys := []string{}
+	values := []string{}
+
+	eachChild([]byte(` [1,null,3]`), func(key string, value []byte) {
+		keys = append(keys, key)
+		values = append(values, string(value))
+	})
+
+	assert.Equal(t, []string{"0", "2"}, keys)
+	assert.Equal(t, []string{"1", "3"}, values)
+}
+
+func TestMatchesArray(t *testing.T) {
+	json := decoded([]byte(`{"managers":[{"supervisors":["fiz","fuz"]},null,{"supervisors":{"no":"no"}}]}`))
+
+	assert.Equal(t, [][]string{
+		{"managers", "0", "supervisors", "0"},
+		{"managers", "0", "supervisors", "1"},
+		{"managers", "2", "supervisors", "no"},
+	}, matches(json, []string{"managers", "*", "supervisors", "*"}))
+
+	assert.Equal(t, [][]string{
+		{"managers", "2", "supervisors"},
+	}, matches(json, []string{"managers", "2", "supervisors"}))
+
+	assert.Equal(t, [][]string{
+		{"managers", "0", "supervisors", "1"},
+	}, matchesWithin(json, []string{"managers", "*", "supervisors", "*"}, [][]string{{"managers", "0", "supervisors", "1"}}))
+}
@@ -0,0 +1,45 @@
+package firebasehelpers
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Decodes value into new T, nil value is decoded as nil pointer
+func decode[T any](value []byte) (*T, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	result := new(T)
+
+	if err := json.Unmarshal(value, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ListenAs is like Stream.Listen, but decodes previous and current values
+// into T. Values that fail to decode are reported to stream's error handler
+// and callback is not called for them.
+func ListenAs[T any](stream *Stream, pattern []string, cb func(path []string, prev *T, curr *T)) *Listener {
+	return stream.Listen(pattern, func(path []string, prevValue []byte, currValue []byte) {
+		prev, err := decode[T](prevValue)
+
+		if err == nil {
+			var curr *T
+
+			curr, err = decode[T](currValue)
+
+			if err == nil {
+				cb(path, prev, curr)
+				return
+			}
+		}
+
+		stream.pubError(newError(DecodeError, errors.Wrapf(err, "failed to decode value at %s", strings.Join(path, "/"))))
+	})
+}
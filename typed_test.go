@@ -0,0 +1,47 @@
+package firebasehelpers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type manager struct {
+	Name string `json:"name"`
+}
+
+func TestListenAs(t *testing.T) {
+	errs := make(chan error, 1)
+
+	stream := NewStreamContext(context.Background(), StreamOptions{
+		Strict: true,
+		ErrHandler: func(err error) {
+			errs <- err
+		},
+	})
+	defer stream.Shutdown()
+
+	type change struct {
+		path []string
+		prev *manager
+		curr *manager
+	}
+
+	changes := make(chan change, 10)
+
+	ListenAs(stream, []string{"managers", "*"}, func(path []string, prev *manager, curr *manager) {
+		changes <- change{path, prev, curr}
+	})
+
+	stream.Push([]byte(`{"managers":{"foo":{"name":"Foo"}}}`))
+	stream.Push([]byte(`{"managers":{"foo":{"name":"Fiz"},"bar":"invalid"}}`))
+	stream.Push([]byte(`{"managers":{"bar":{"name":"Bar"}}}`))
+
+	assert.Equal(t, change{[]string{"managers", "foo"}, nil, &manager{"Foo"}}, <-changes)
+	assert.Equal(t, change{[]string{"managers", "foo"}, &manager{"Foo"}, &manager{"Fiz"}}, <-changes)
+	err := <-errs
+	assert.EqualError(t, err, "failed to decode value at managers/bar: json: cannot unmarshal string into Go value of type firebasehelpers.manager")
+	assert.Equal(t, DecodeError, KindOf(err))
+	assert.Equal(t, change{[]string{"managers", "foo"}, &manager{"Fiz"}, nil}, <-changes)
+}
@@ -0,0 +1,88 @@
+package firebasehelpers
+
+import (
+	"context"
+	"sync"
+)
+
+// WaitFor blocks until value at cursor path satisfies predicate and returns
+// its snapshot. Predicate is called only on the calling goroutine, with each
+// value processed by the stream in order. It fails when ctx is done or the
+// stream shuts down. It must not be called from listener callbacks, as they
+// block the stream.
+func (c *cursor) WaitFor(ctx context.Context, predicate func(Snapshot) bool) (Snapshot, error) {
+	// Listener only passes snapshots to the calling goroutine
+	var pending []Snapshot
+	var pendingMux sync.Mutex
+
+	signal := make(chan struct{}, 1)
+	last := uint64(0)
+
+	// Listener for root would never be notified, so its children are watched
+	target := c
+
+	if len(c.path) == 0 {
+		target = c.Select("*")
+	}
+
+	listener := c.stream.listen(target, func(event Event) {
+		// Value changing many matched paths is passed once
+		if event.Revision == last {
+			return
+		}
+
+		last = event.Revision
+		snapshot := c.Snapshot()
+
+		pendingMux.Lock()
+		pending = append(pending, snapshot)
+		pendingMux.Unlock()
+
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+	})
+
+	defer listener.shutdown()
+
+	// Value could be set before listener was registered
+	snapshot := c.Snapshot()
+
+	if predicate(snapshot) {
+		return snapshot, nil
+	}
+
+	checked := snapshot.Revision()
+
+	for {
+		select {
+		case <-signal:
+			pendingMux.Lock()
+			snapshots := pending
+			pending = nil
+			pendingMux.Unlock()
+
+			for _, snapshot := range snapshots {
+				if snapshot.Revision() <= checked {
+					continue
+				}
+
+				if predicate(snapshot) {
+					return snapshot, nil
+				}
+
+				checked = snapshot.Revision()
+			}
+		case <-ctx.Done():
+			return Snapshot{}, ctx.Err()
+		case <-c.stream.ctx.Done():
+			return Snapshot{}, ErrStreamClosed
+		}
+	}
+}
+
+// Once blocks until there is value at cursor path and returns its snapshot
+func (c *cursor) Once(ctx context.Context) (Snapshot, error) {
+	return c.WaitFor(ctx, Snapshot.Exists)
+}
@@ -0,0 +1,114 @@
+package firebasehelpers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnce(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+	defer stream.Shutdown()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stream.Push([]byte(`{"config":{"debug":true}}`))
+	}()
+
+	snapshot, err := stream.Select("config", "debug").Once(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("true"), snapshot.Raw())
+
+	snapshot, err = stream.Select("config").Once(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`{"debug":true}`), snapshot.Raw())
+
+	stream.processMux.Lock()
+	assert.Empty(t, stream.listeners)
+	stream.processMux.Unlock()
+}
+
+func TestWaitFor(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	go func() {
+		for _, value := range []string{`{"count":1}`, `{"count":2}`, `{"count":3}`} {
+			time.Sleep(time.Millisecond)
+			stream.Push([]byte(value))
+		}
+	}()
+
+	snapshot, err := stream.Select("count").WaitFor(context.Background(), func(snapshot Snapshot) bool {
+		var count int
+		snapshot.Decode(&count)
+		return count >= 2
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), snapshot.Raw())
+}
+
+func TestWaitForRoot(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+	defer stream.Shutdown()
+
+	go stream.Push([]byte(`{"foo":"bar"}`))
+
+	snapshot, err := stream.Select().Once(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`{"foo":"bar"}`), snapshot.Raw())
+}
+
+func TestWaitForCancel(t *testing.T) {
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := stream.Select("config").Once(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	go stream.Shutdown()
+
+	_, err = stream.Select("config").Once(context.Background())
+	assert.Equal(t, ErrStreamClosed, err)
+}
+
+func TestWaitForCallsPredicateOnCallingGoroutine(t *testing.T) {
+	stream := NewStreamContext(context.Background(), StreamOptions{Strict: true})
+	defer stream.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	go func() {
+		for _, value := range []string{`{"count":1}`, `{"count":2}`} {
+			stream.Push([]byte(value))
+		}
+	}()
+
+	snapshot, err := stream.Select("count").WaitFor(ctx, func(snapshot Snapshot) bool {
+		// Predicate called by the stream would deadlock here
+		stream.processMux.Lock()
+		defer stream.processMux.Unlock()
+
+		var count int
+		snapshot.Decode(&count)
+		return count >= 2
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), snapshot.Raw())
+}
@@ -0,0 +1,239 @@
+package firebasehelpers
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Overflow tells what happens with events when receiver can't keep up
+type Overflow int
+
+const (
+	// OverflowDefault is OverflowBlock for Watch and OverflowCoalesce for
+	// async listeners
+	OverflowDefault Overflow = iota
+	// OverflowBlock makes the stream wait until there's space for the event,
+	// which delays all other listeners of the stream
+	OverflowBlock
+	// OverflowDropOldest drops oldest waiting event to make space for new one,
+	// so receiver can see a value removed without seeing it added. Each dropped
+	// event is reported to ErrHandler as OverflowError and counted in
+	// StreamStats.DroppedEvents.
+	OverflowDropOldest
+	// OverflowCoalesce merges new event with waiting event for the same path,
+	// for example Added and Changed become one Added event. If there's no
+	// such event and no space, the stream waits like with OverflowBlock.
+	OverflowCoalesce
+)
+
+// Returns fallback if overflow policy isn't set
+func (o Overflow) or(fallback Overflow) Overflow {
+	if o == OverflowDefault {
+		return fallback
+	}
+
+	return o
+}
+
+// WatchOptions configures channel returned by cursor.Watch
+type WatchOptions struct {
+	// Buffer is number of events waiting for receiver, 64 if not set
+	Buffer int
+	// Overflow tells what happens with events when buffer is full,
+	// OverflowBlock by default
+	Overflow Overflow
+}
+
+// Merges event with the one that follows it for the same path. Returns false
+// if the events cancel each other out.
+func mergeEvents(first Event, second Event) (Event, bool) {
+	result := second
+	result.Prev = first.Prev
+
+	switch {
+	case result.Prev == nil && result.Curr == nil:
+		return Event{}, false
+	case result.Prev == nil:
+		result.Kind = Added
+	case result.Curr == nil:
+		result.Kind = Removed
+	case string(result.Prev) == string(result.Curr):
+		return Event{}, false
+	default:
+		result.Kind = Changed
+	}
+
+	return result, true
+}
+
+// Bounded queue of events handling overflow according to its policy. Dropped
+// events are passed to dropped if it's set.
+type eventQueue struct {
+	events   []Event
+	size     int
+	overflow Overflow
+	dropped  func(Event)
+	signal   chan struct{}
+	space    chan struct{}
+	mux      sync.Mutex
+}
+
+func newEventQueue(size int, overflow Overflow, dropped func(Event)) *eventQueue {
+	return &eventQueue{
+		size:     size,
+		overflow: overflow,
+		dropped:  dropped,
+		signal:   make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Adds event to the queue, waiting for space until done is closed if needed
+func (q *eventQueue) push(event Event, done <-chan struct{}) {
+	for {
+		ok, dropped := q.tryPush(event)
+
+		if dropped != nil && q.dropped != nil {
+			q.dropped(*dropped)
+		}
+
+		if ok {
+			notify(q.signal)
+			return
+		}
+
+		select {
+		case <-q.space:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Adds event to the queue if there's space or it can be made, and returns
+// event dropped to make it
+func (q *eventQueue) tryPush(event Event) (bool, *Event) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.overflow == OverflowCoalesce {
+		key := strings.Join(event.Path, "/")
+
+		for i, waiting := range q.events {
+			if strings.Join(waiting.Path, "/") == key {
+				if merged, ok := mergeEvents(waiting, event); ok {
+					q.events[i] = merged
+				} else {
+					q.events = append(q.events[:i], q.events[i+1:]...)
+				}
+
+				return true, nil
+			}
+		}
+	}
+
+	var dropped *Event
+
+	if len(q.events) >= q.size {
+		if q.overflow != OverflowDropOldest {
+			return false, nil
+		}
+
+		dropped = &q.events[0]
+		q.events = q.events[1:]
+	}
+
+	q.events = append(q.events, event)
+
+	return true, dropped
+}
+
+// Returns first event in the queue, if there is any
+func (q *eventQueue) pop() (Event, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.events) == 0 {
+		return Event{}, false
+	}
+
+	event := q.events[0]
+	q.events = q.events[1:]
+
+	notify(q.space)
+
+	if len(q.events) > 0 {
+		notify(q.signal)
+	}
+
+	return event, true
+}
+
+// Watch returns channel of events for paths matching pattern relative to the
+// cursor, as reported by Stream.ListenEvents. The channel is closed when ctx
+// is done or the stream shuts down.
+func (c *cursor) Watch(ctx context.Context, pattern []string, opts WatchOptions) <-chan Event {
+	size := opts.Buffer
+
+	if size <= 0 {
+		size = 64
+	}
+
+	stream := c.stream
+	target := c.Select(pattern...)
+
+	queue := newEventQueue(size, opts.Overflow.or(OverflowBlock), func(event Event) {
+		target.stream.dropEvent(target, event)
+	})
+
+	out := make(chan Event)
+
+	done := make(chan struct{})
+
+	listener := stream.listen(target, func(event Event) {
+		queue.push(event, done)
+	})
+
+	stream.Async(func() {
+		defer close(out)
+
+		defer func() {
+			// Callback must stop waiting for space before listener is removed
+			close(done)
+			listener.shutdown()
+		}()
+
+		for {
+			event, ok := queue.pop()
+
+			if !ok {
+				select {
+				case <-queue.signal:
+					continue
+				case <-ctx.Done():
+					return
+				case <-stream.ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			case <-stream.ctx.Done():
+				return
+			}
+		}
+	}, "watch")
+
+	return out
+}
@@ -0,0 +1,113 @@
+package firebasehelpers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeEvents(t *testing.T) {
+	added := Event{Kind: Added, Path: []string{"foo"}, Curr: []byte("1")}
+	changed := Event{Kind: Changed, Path: []string{"foo"}, Prev: []byte("1"), Curr: []byte("2")}
+	removed := Event{Kind: Removed, Path: []string{"foo"}, Prev: []byte("2")}
+
+	merged, ok := mergeEvents(added, changed)
+	assert.True(t, ok)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"foo"}, Curr: []byte("2")}, merged)
+
+	merged, ok = mergeEvents(changed, removed)
+	assert.True(t, ok)
+	assert.Equal(t, Event{Kind: Removed, Path: []string{"foo"}, Prev: []byte("1")}, merged)
+
+	_, ok = mergeEvents(added, removed)
+	assert.False(t, ok)
+}
+
+func TestEventQueueDropOldest(t *testing.T) {
+	queue := newEventQueue(2, OverflowDropOldest, nil)
+
+	for _, key := range []string{"a", "b", "c"} {
+		queue.push(Event{Path: []string{key}}, nil)
+	}
+
+	first, _ := queue.pop()
+	second, _ := queue.pop()
+	_, ok := queue.pop()
+
+	assert.Equal(t, []string{"b"}, first.Path)
+	assert.Equal(t, []string{"c"}, second.Path)
+	assert.False(t, ok)
+}
+
+func TestEventQueueCoalesce(t *testing.T) {
+	queue := newEventQueue(2, OverflowCoalesce, nil)
+
+	queue.push(Event{Kind: Added, Path: []string{"a"}, Curr: []byte("1")}, nil)
+	queue.push(Event{Kind: Added, Path: []string{"b"}, Curr: []byte("1")}, nil)
+	queue.push(Event{Kind: Changed, Path: []string{"a"}, Prev: []byte("1"), Curr: []byte("2")}, nil)
+
+	first, _ := queue.pop()
+	second, _ := queue.pop()
+
+	assert.Equal(t, Event{Kind: Added, Path: []string{"a"}, Curr: []byte("2")}, first)
+	assert.Equal(t, Event{Kind: Added, Path: []string{"b"}, Curr: []byte("1")}, second)
+}
+
+func TestEventQueueBlock(t *testing.T) {
+	queue := newEventQueue(1, OverflowBlock, nil)
+	done := make(chan struct{})
+
+	queue.push(Event{Path: []string{"a"}}, done)
+
+	pushed := make(chan struct{})
+
+	go func() {
+		queue.push(Event{Path: []string{"b"}}, done)
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Error("Push should wait for space")
+	default:
+	}
+
+	queue.pop()
+	<-pushed
+
+	event, _ := queue.pop()
+	assert.Equal(t, []string{"b"}, event.Path)
+}
+
+func TestCursorWatch(t *testing.T) {
+	defer verifyNoLeaks(t)
+
+	stream := NewStream(func(err error) {
+		t.Error(err)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	events := stream.Select("managers").Watch(ctx, []string{"*"}, WatchOptions{})
+
+	stream.Push([]byte(`{"managers":{"foo":1}}`))
+
+	event := <-events
+	assert.Equal(t, Added, event.Kind)
+	assert.Equal(t, []string{"managers", "foo"}, event.Path)
+
+	cancel()
+
+	for range events {
+	}
+
+	stream.Push([]byte(`{"managers":{"foo":2}}`))
+
+	closed := stream.Select().Watch(context.Background(), []string{"*"}, WatchOptions{})
+
+	stream.Shutdown()
+
+	for range closed {
+	}
+}